@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	in := flag.String("plan", "plan.json", "the plan file to execute, as written by plan")
+
+	c := gosync.NewConfig()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	p, err := gosync.ReadPlan(f)
+	f.Close()
+	if err != nil {
+		fmt.Println("Invalid plan : ", err)
+		os.Exit(1)
+	}
+	fmt.Println("Applying the plan", *in)
+	fmt.Println(c)
+	fmt.Println(p)
+
+	fmt.Printf("If that plan is correct, type 'yes' to continue:")
+	yes := ""
+	fmt.Scanln(&yes)
+	if yes == "yes" {
+		r, err := c.Apply(p)
+		if r == nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		c.WriteReport(os.Stdout, r)
+		if err != nil {
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("Aborting ...")
+	}
+
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/xavier268/go-s3sync/pkg/gosync"
 )
@@ -12,7 +13,13 @@ func main() {
 	c := gosync.NewConfig().SetMode(gosync.ModeBackupMock)
 	fmt.Println(c)
 
-	c.ProcessObjects()
-	c.ProcessFiles()
+	r, err := c.Sync()
+	if r != nil {
+		c.WriteReport(os.Stdout, r)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	fmt.Println("Synchronizing files and s3 in both directions")
+
+	c := gosync.NewConfig().SetMode(gosync.ModeBidirectional)
+	fmt.Println(c)
+
+	fmt.Printf("If that configuration is correct, type 'yes' to continue:")
+	yes := ""
+	fmt.Scanln(&yes)
+	if yes == "yes" {
+		r, err := c.Sync()
+		if r != nil {
+			c.WriteReport(os.Stdout, r)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("Aborting ...")
+	}
+
+}
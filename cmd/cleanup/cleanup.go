@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-"github.com/xavier268/go-s3sync/pkg/gosync"
+	"github.com/xavier268/go-s3sync/pkg/gosync"
 )
 
 func main() {
@@ -16,7 +17,10 @@ func main() {
 	yes := ""
 	fmt.Scanln(&yes)
 	if yes == "yes" {
-		c.RemoveAllEmptyDirs()
+		if err := c.RemoveAllEmptyDirs(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else {
 		fmt.Println("Aborting ...")
 	}
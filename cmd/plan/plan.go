@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	out := flag.String("out", "plan.json", "the file the plan is written to")
+	restore := flag.Bool("restore", false, "plan a restore, instead of a backup")
+	bidi := flag.Bool("bidirectional", false, "plan a bidirectional sync, instead of a backup")
+
+	c := gosync.NewConfig().SetMode(gosync.ModeBackupMock)
+	if *restore {
+		c.SetMode(gosync.ModeRestoreMock)
+	}
+	if *bidi {
+		c.SetMode(gosync.ModeBidirectionalMock)
+	}
+	fmt.Println("Planning, without changing anything")
+	fmt.Println(c)
+
+	p, err := c.Plan()
+	if p == nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(p)
+
+	f, e := os.Create(*out)
+	if e == nil {
+		e = p.Write(f)
+		if e2 := f.Close(); e == nil {
+			e = e2
+		}
+	}
+	if e != nil {
+		fmt.Println("The plan could not be written : ", e)
+		os.Exit(1)
+	}
+	fmt.Println("Plan written to", *out, ", use apply to execute it")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	var p gosync.RetentionPolicy
+	flag.IntVar(&p.Last, "keep-last", 0, "keep the most recent snapshots")
+	flag.IntVar(&p.Daily, "keep-daily", 7, "keep the most recent snapshot of as many days")
+	flag.IntVar(&p.Weekly, "keep-weekly", 4, "keep the most recent snapshot of as many weeks")
+	flag.IntVar(&p.Monthly, "keep-monthly", 12, "keep the most recent snapshot of as many months")
+	flag.DurationVar(&p.Grace, "grace", 24*time.Hour, "ignore the locks older than this duration, left by crashed runs")
+	dryRun := flag.Bool("dry-run", false, "only report what would be deleted, and the bytes reclaimed")
+
+	c := gosync.NewConfig().SetMode(gosync.ModePrune)
+	if *dryRun {
+		c.SetMode(gosync.ModePruneMock)
+	}
+	fmt.Println("Pruning the snapshots, keeping", p)
+	fmt.Println(c)
+
+	if !*dryRun {
+		fmt.Printf("If that configuration is correct, type 'yes' to continue:")
+		yes := ""
+		fmt.Scanln(&yes)
+		if yes != "yes" {
+			fmt.Println("Aborting ...")
+			return
+		}
+	}
+	r, err := c.Prune(p)
+	if r != nil {
+		c.WriteReport(os.Stdout, r)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+}
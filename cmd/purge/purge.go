@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	retention := flag.Duration("retention", 30*24*time.Hour, "keep the trashed files and objects more recent than this duration")
+
+	c := gosync.NewConfig().SetMode(gosync.ModePurgeTrash).SetTrash(true)
+	fmt.Println("Purging the trash, for files and objects trashed more than", *retention, "ago")
+	fmt.Println(c)
+
+	fmt.Printf("If that configuration is correct, type 'yes' to continue:")
+	yes := ""
+	fmt.Scanln(&yes)
+	if yes == "yes" {
+		r, err := c.PurgeTrash(*retention)
+		if r != nil {
+			c.WriteReport(os.Stdout, r)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("Aborting ...")
+	}
+
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-"github.com/xavier268/go-s3sync/pkg/gosync"
+	"github.com/xavier268/go-s3sync/pkg/gosync"
 )
 
 func main() {
@@ -16,8 +17,14 @@ func main() {
 	yes := ""
 	fmt.Scanln(&yes)
 	if yes == "yes" {
-		c.ProcessObjects()
-		c.ProcessFiles()
+		r, err := c.Sync()
+		if r != nil {
+			c.WriteReport(os.Stdout, r)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else {
 		fmt.Println("Aborting ...")
 	}
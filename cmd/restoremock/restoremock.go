@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-"github.com/xavier268/go-s3sync/pkg/gosync"
+	"github.com/xavier268/go-s3sync/pkg/gosync"
 )
 
 func main() {
@@ -12,6 +13,12 @@ func main() {
 	c := gosync.NewConfig().SetMode(gosync.ModeRestoreMock)
 	fmt.Println(c)
 
-	c.ProcessObjects()
-	c.ProcessFiles()
+	r, err := c.Sync()
+	if r != nil {
+		c.WriteReport(os.Stdout, r)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
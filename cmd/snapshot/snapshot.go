@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	list := flag.Bool("list", false, "list the snapshot ids, instead of taking a snapshot")
+
+	c := gosync.NewConfig().SetMode(gosync.ModeSnapshot)
+	if *list {
+		ids, err := c.Snapshots()
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Println("Taking a snapshot of the files into s3")
+	fmt.Println(c)
+
+	fmt.Printf("If that configuration is correct, type 'yes' to continue:")
+	yes := ""
+	fmt.Scanln(&yes)
+	if yes == "yes" {
+		r, err := c.Snapshot()
+		if r != nil {
+			c.WriteReport(os.Stdout, r)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("Aborting ...")
+	}
+
+}
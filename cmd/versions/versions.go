@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xavier268/go-s3sync/pkg/gosync"
+)
+
+func main() {
+	path := flag.String("path", "", "the file, relative to the prefix, whose versions are listed")
+
+	c := gosync.NewConfig()
+	fmt.Println("Listing the versions of", *path)
+	fmt.Println(c)
+
+	versions, err := c.Versions(*path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Updated\tSize\tVersion\tStatus\n")
+	for _, v := range versions {
+		status := ""
+		if v.DeleteMarker {
+			status = "deleted"
+		}
+		if v.Latest {
+			status += " latest"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", v.Updated.Format(time.RFC3339), v.Size, v.VersionID, status)
+	}
+	w.Flush()
+	fmt.Println(len(versions), "versions, use restore -as-of to restore a point in time")
+
+}
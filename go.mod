@@ -1,9 +1,11 @@
 module github.com/xavier268/go-s3sync
 
-go 1.13
+go 1.21
+
+require github.com/aws/aws-sdk-go v1.27.0
 
 require (
-	github.com/aws/aws-sdk-go v1.27.0
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
 	github.com/stretchr/testify v1.4.0 // indirect
 	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553 // indirect
 	golang.org/x/text v0.3.2 // indirect
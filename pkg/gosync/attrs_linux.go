@@ -0,0 +1,135 @@
+//go:build linux
+
+package gosync
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// changeTime returns the file status change time.
+func changeTime(info os.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Ctim.Unix()).UTC()
+}
+
+// ownerAttrs returns the uid and gid of the file, as metadata.
+func ownerAttrs(info os.FileInfo) map[string]string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return map[string]string{
+		metaUID: strconv.FormatUint(uint64(st.Uid), 10),
+		metaGID: strconv.FormatUint(uint64(st.Gid), 10),
+	}
+}
+
+// canChown is true when the process may give files away, see applyOwner.
+var canChown = func() bool {
+	return os.Geteuid() == 0
+}
+
+// applyOwner sets the uid and gid stored in meta.
+// Only root may give a file away, so permission errors are ignored.
+func applyOwner(absPath string, meta map[string]string) error {
+	suid, ok1 := meta[metaUID]
+	sgid, ok2 := meta[metaGID]
+	if !ok1 || !ok2 {
+		return nil
+	}
+	uid, err := strconv.Atoi(suid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(sgid)
+	if err != nil {
+		return err
+	}
+	err = os.Lchown(absPath, uid, gid)
+	if os.IsPermission(err) {
+		return nil
+	}
+	return err
+}
+
+// xattrs returns the extended attributes of the file,
+// as the base64 encoding of a JSON object, empty if there are none.
+func xattrs(absPath string) (string, error) {
+	sz, err := syscall.Listxattr(absPath, nil)
+	if err != nil || sz == 0 {
+		return "", ignoreNotSupported(err)
+	}
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(absPath, buf)
+	if err != nil {
+		return "", ignoreNotSupported(err)
+	}
+	names := bytes.Split(bytes.TrimRight(buf[:sz], "\x00"), []byte{0})
+	sort.Slice(names, func(i, j int) bool { return bytes.Compare(names[i], names[j]) < 0 })
+
+	attrs := make(map[string][]byte, len(names))
+	for _, n := range names {
+		name := string(n)
+		sz, err := syscall.Getxattr(absPath, name, nil)
+		if err != nil {
+			return "", err
+		}
+		val := make([]byte, sz)
+		if sz > 0 {
+			if sz, err = syscall.Getxattr(absPath, name, val); err != nil {
+				return "", err
+			}
+		}
+		attrs[name] = val[:sz]
+	}
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// applyXattrs sets the extended attributes stored in meta.
+// Attributes the file system or the user cannot set, such as trusted.*, are ignored.
+func applyXattrs(absPath string, meta map[string]string) error {
+	s, ok := meta[metaXattrs]
+	if !ok || s == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	var attrs map[string][]byte
+	if err = json.Unmarshal(data, &attrs); err != nil {
+		return err
+	}
+	for name, val := range attrs {
+		err = syscall.Setxattr(absPath, name, val, 0)
+		if err != nil && !os.IsPermission(err) {
+			if err = ignoreNotSupported(err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ignoreNotSupported ignores the errors of file systems without extended attributes.
+func ignoreNotSupported(err error) error {
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+
+package gosync
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime is unknown on this platform.
+func changeTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// ownerAttrs is not supported on this platform, only the mode is preserved.
+func ownerAttrs(info os.FileInfo) map[string]string {
+	return nil
+}
+
+// canChown is false, ownership not being supported on this platform.
+var canChown = func() bool {
+	return false
+}
+
+// applyOwner is not supported on this platform.
+func applyOwner(absPath string, meta map[string]string) error {
+	return nil
+}
+
+// xattrs is not supported on this platform.
+func xattrs(absPath string) (string, error) {
+	return "", nil
+}
+
+// applyXattrs is not supported on this platform.
+func applyXattrs(absPath string, meta map[string]string) error {
+	return nil
+}
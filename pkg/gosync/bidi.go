@@ -0,0 +1,168 @@
+package gosync
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConflictPolicy selects how the bidirectional modes resolve conflicts,
+// when a file and its object both changed since the last sync.
+type ConflictPolicy int
+
+// ConflictKeepNewer keeps the most recently modified side.
+// ConflictKeepBoth downloads the object, after renaming the file with a conflict suffix,
+// see conflictName. The renamed file is uploaded by the next run.
+// ConflictAbort reports the conflicts, and performs nothing.
+const (
+	ConflictKeepNewer ConflictPolicy = iota
+	ConflictKeepBoth
+	ConflictAbort
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictKeepNewer:
+		return "keep-newer"
+	case ConflictKeepBoth:
+		return "keep-both"
+	case ConflictAbort:
+		return "abort"
+	default:
+		return "invalid(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+// Set parses the conflict policy, so that it can be used as a flag.
+func (p *ConflictPolicy) Set(s string) error {
+	for _, m := range []ConflictPolicy{ConflictKeepNewer, ConflictKeepBoth, ConflictAbort} {
+		if m.String() == s {
+			*p = m
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid conflict policy %q, use keep-newer, keep-both or abort", s)
+}
+
+// Reasons of the bidirectional actions.
+const (
+	reasonLocalChanged   = "local changed"
+	reasonRemoteChanged  = "remote changed"
+	reasonLocalDeleted   = "deleted locally"
+	reasonRemoteDeleted  = "deleted remotely"
+	reasonConflictNewer  = "conflict, keep newer"
+	reasonConflictBoth   = "conflict, keep both"
+	reasonConflictReport = "conflict"
+)
+
+// errConflict is the cause of the conflicts reported with ConflictAbort.
+var errConflict = errors.New("file and object both changed since the last sync")
+
+// decideBidi decides the action for a key in the bidirectional modes,
+// using the state of the last sync as the baseline :
+//   - a new file, or object, is copied to the other side,
+//   - a change on one side only is copied to the other side,
+//   - a deletion of a file, or object, unchanged on the other side, is propagated,
+//     but a change wins over a deletion,
+//   - a change on both sides, with different contents, is a conflict, see ConflictPolicy.
+func (c *Config) decideBidi(d *diff, a *action) bool {
+	rel := c.keyRel(d.key)
+
+	switch {
+	case d.file != nil && d.object != nil:
+		if d.err != nil {
+			// Cannot decide, do nothing.
+			c.fail(OpHash, d.key, d.err)
+			return false
+		}
+		if d.same {
+			count(&c.report.Identical, 1)
+			c.log.Debug("identical", "key", d.key)
+			return false
+		}
+		a.absPath = d.file.absPath
+		switch {
+		case d.fileChanged && !d.objectChanged:
+			a.op, a.reason = OpUpload, reasonLocalChanged
+		case !d.fileChanged && d.objectChanged:
+			a.op, a.reason = OpDownload, reasonRemoteChanged
+		default:
+			return c.resolve(d, a)
+		}
+
+	case d.file != nil:
+		a.absPath = d.file.absPath
+		fileChanged, _ := c.state.changed(rel, d.file, nil)
+		if c.state.synced(rel) && !fileChanged {
+			a.op, a.reason = OpDeleteFile, reasonRemoteDeleted
+		} else {
+			a.op, a.reason = OpUpload, reasonLocalOnly
+		}
+
+	default:
+		absPath, ok := c.remoteOnly(d)
+		if !ok {
+			return false
+		}
+		a.absPath = absPath
+		_, objectChanged := c.state.changed(rel, nil, d.object)
+		if c.state.synced(rel) && !objectChanged {
+			a.op, a.reason = OpDeleteObject, reasonLocalDeleted
+		} else {
+			a.op, a.reason = OpDownload, reasonRemoteOnly
+		}
+	}
+	return true
+}
+
+// resolve resolves a conflict, according to the conflict policy.
+func (c *Config) resolve(d *diff, a *action) bool {
+	count(&c.report.Conflicts, 1)
+	switch c.conflicts {
+	case ConflictAbort:
+		c.fail(OpConflict, d.key, errConflict)
+		return false
+	case ConflictKeepBoth:
+		a.op, a.reason, a.keepBoth = OpDownload, reasonConflictBoth, true
+	default:
+		ob := *d.object
+		if ob.Meta == nil {
+			// listings do not provide the metadata
+			h, err := c.store.Head(ob.Key)
+			if err != nil {
+				c.fail(OpHead, d.key, err)
+				return false
+			}
+			ob = h
+		}
+		mtime, ok := storedMtime(ob)
+		if !ok {
+			mtime = ob.Updated
+		}
+		a.op, a.reason = OpUpload, reasonConflictNewer
+		if mtime.After(d.file.updated) {
+			a.op = OpDownload
+		}
+	}
+	c.log.Warn("conflict", "key", d.key, "policy", c.conflicts.String(), "op", a.op)
+	return true
+}
+
+// conflictName returns the name the file is renamed to, when keeping both sides,
+// adding a suffix with the UTC time before the extension.
+func conflictName(absPath string, t time.Time) string {
+	ext := filepath.Ext(absPath)
+	if strings.HasPrefix(filepath.Base(absPath), ".") && ext == filepath.Base(absPath) {
+		// dot file, without extension
+		ext = ""
+	}
+	return strings.TrimSuffix(absPath, ext) + ".conflict-" + t.UTC().Format("20060102-150405") + ext
+}
+
+// keyRel returns the slash separated path of the file of a key, relative to the prefix.
+func (c *Config) keyRel(key string) string {
+	return strings.TrimPrefix(key[len(c.keyPrefix):], "/")
+}
@@ -0,0 +1,322 @@
+package gosync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ChunkStore is a Store adapter splitting the object contents into chunks,
+// with content-defined chunking, so that only the changed chunks of a modified file are sent,
+// and that identical chunks, across files and machines, are stored once.
+//
+// Chunks are stored in the base store as chunks/<sha256>, at the root of the bucket,
+// or by the name the base store gives them, see nameHasher.
+// Each object is stored as the list of its chunks, in JSON, with its metadata,
+// and the size of its content in the metaChunked metadata.
+// Objects stored without chunking are read as is.
+// Chunks are not deleted with the objects, as other objects may use them,
+// but by Config.Prune, when no object uses them.
+//
+// As S3 listings do not provide the metadata, List does not provide the sizes,
+// the comparisons heading the objects when they need them.
+// The ETag is the one of the chunk list : use the sha256 hash mode to compare contents.
+type ChunkStore struct {
+	Store
+	// chunk sizes, see setChunkSizes.
+	min, max int
+	mask     uint64
+	// chunks known to be stored, listed upon the first Put.
+	lock  sync.Mutex
+	known map[string]bool
+}
+
+// chunksKeyPrefix is the key prefix of the chunks, see ChunkStore.
+const chunksKeyPrefix = "chunks/"
+
+// metaChunked is the metadata holding the content size of a chunked object.
+const metaChunked = "chunked-size"
+
+// Default chunk sizes : 256 KiB minimum, 1 MiB on average, 4 MiB maximum.
+const (
+	chunkMin = 256 << 10
+	chunkAvg = 1 << 20
+	chunkMax = 4 << 20
+)
+
+// chunkList is the content of a chunked object.
+type chunkList struct {
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// NewChunkStore creates a chunking adapter of the base store.
+func NewChunkStore(base Store) *ChunkStore {
+	return new(ChunkStore).setChunkSizes(base, chunkMin, chunkAvg, chunkMax)
+}
+
+// setChunkSizes sets the base store, and the chunk sizes, avg being a power of 2.
+func (s *ChunkStore) setChunkSizes(base Store, min, avg, max int) *ChunkStore {
+	s.Store, s.min, s.max = base, min, max
+	// the cut points are decided by the high bits of the gear hash,
+	// that depend on the last 64 bytes.
+	bits := 0
+	for 1<<bits < avg {
+		bits++
+	}
+	s.mask = (uint64(1)<<bits - 1) << (64 - bits)
+	return s
+}
+
+func (s *ChunkStore) String() string {
+	return fmt.Sprintf("%v (chunked)", s.Store)
+}
+
+// gear is the random table of the rolling gear hash,
+// from a fixed seed so that chunks are the same everywhere.
+var gear = func() (g [256]uint64) {
+	x := uint64(0x9E3779B97F4A7C15)
+	for i := range g {
+		// splitmix64
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		g[i] = z ^ (z >> 31)
+	}
+	return g
+}()
+
+// split reads r, calling fn for each chunk, whose content is only valid during the call.
+// Cut points depend on the content only, so that an insertion only changes the chunks around it.
+func (s *ChunkStore) split(r io.Reader, fn func([]byte) error) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	buf := make([]byte, 0, s.max)
+	var h uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		h = h<<1 + gear[b]
+		if (len(buf) >= s.min && h&s.mask == 0) || len(buf) >= s.max {
+			if err = fn(buf); err != nil {
+				return err
+			}
+			buf, h = buf[:0], 0
+		}
+	}
+	if len(buf) > 0 {
+		return fn(buf)
+	}
+	return nil
+}
+
+// loadKnown lists the stored chunks, once.
+// Caller must hold the lock.
+func (s *ChunkStore) loadKnown() error {
+	if s.known != nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	err := s.Store.List(chunksKeyPrefix, func(ob DstObject) error {
+		known[strings.TrimPrefix(ob.Key, chunksKeyPrefix)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.known = known
+	return nil
+}
+
+// hashName names the chunks as the base store does, if it does, see nameHasher.
+func (s *ChunkStore) hashName(sum string) string {
+	if h, ok := s.Store.(nameHasher); ok {
+		return h.hashName(sum)
+	}
+	return sum
+}
+
+// putChunk stores a chunk, unless already stored, and returns its name.
+func (s *ChunkStore) putChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	id := s.hashName(hex.EncodeToString(sum[:]))
+	s.lock.Lock()
+	err := s.loadKnown()
+	known := s.known[id]
+	s.lock.Unlock()
+	if err != nil || known {
+		return id, err
+	}
+	if err = s.Store.Put(chunksKeyPrefix+id, bytes.NewReader(data), nil); err != nil {
+		return id, err
+	}
+	s.lock.Lock()
+	s.known[id] = true
+	s.lock.Unlock()
+	return id, nil
+}
+
+// Put stores the missing chunks of the content, then its chunk list.
+func (s *ChunkStore) Put(key string, r io.Reader, meta map[string]string) error {
+	var list chunkList
+	err := s.split(r, func(data []byte) error {
+		id, err := s.putChunk(data)
+		list.Chunks = append(list.Chunks, id)
+		list.Size += int64(len(data))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	m := copyMeta(meta)
+	m[metaChunked] = strconv.FormatInt(list.Size, 10)
+	return s.Store.Put(key, bytes.NewReader(data), m)
+}
+
+// object converts the description of a chunk list into the one of the content.
+func (s *ChunkStore) object(ob DstObject) DstObject {
+	if n, err := strconv.ParseInt(ob.Meta[metaChunked], 10, 64); err == nil {
+		ob.Size = n
+		delete(ob.Meta, metaChunked)
+	}
+	return ob
+}
+
+// List lists the objects, without the chunks.
+// The size of their content is unknown, see DstObject.
+func (s *ChunkStore) List(prefix string, fn func(DstObject) error) error {
+	return s.Store.List(prefix, func(ob DstObject) error {
+		if strings.HasPrefix(ob.Key, chunksKeyPrefix) {
+			return nil
+		}
+		ob.Size = -1
+		return fn(ob)
+	})
+}
+
+// Head describes the object, with the size of its content.
+func (s *ChunkStore) Head(key string) (DstObject, error) {
+	ob, err := s.Store.Head(key)
+	if err != nil {
+		return ob, err
+	}
+	return s.object(ob), nil
+}
+
+// Get reads the chunks of the object, in sequence.
+func (s *ChunkStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	r, ob, err := s.Store.Get(key)
+	if err != nil || ob.Meta[metaChunked] == "" {
+		return r, ob, err
+	}
+	var list chunkList
+	err = json.NewDecoder(r).Decode(&list)
+	r.Close()
+	if err != nil {
+		return nil, ob, fmt.Errorf("invalid chunk list : %w", err)
+	}
+	return &chunkReader{store: s, chunks: list.Chunks}, s.object(ob), nil
+}
+
+// Copy copies the chunk list of the object, with its metadata, sharing its chunks,
+// with the base store, if it is a Copier.
+func (s *ChunkStore) Copy(src, dst string) error {
+	if c, ok := s.Store.(Copier); ok {
+		return c.Copy(src, dst)
+	}
+	r, ob, err := s.Store.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.Store.Put(dst, r, ob.Meta)
+}
+
+// readList reads the chunks used by an object, none if it is stored without chunking.
+// The object is headed first, so that only the chunk lists are read.
+func (s *ChunkStore) readList(key string) ([]string, error) {
+	if ob, err := s.Store.Head(key); err != nil || ob.Meta[metaChunked] == "" {
+		return nil, err
+	}
+	r, _, err := s.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var list chunkList
+	if err = json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid chunk list : %w", err)
+	}
+	return list.Chunks, nil
+}
+
+// forget forgets the chunks known to be stored, that may have been deleted, see loadKnown.
+func (s *ChunkStore) forget() {
+	s.lock.Lock()
+	s.known = nil
+	s.lock.Unlock()
+}
+
+// chunkReader reads a list of chunks, opening each one in turn,
+// and checking its hash.
+type chunkReader struct {
+	store  *ChunkStore
+	chunks []string
+	cur    io.ReadCloser
+	id     string
+	// hash of the current chunk
+	hash hash.Hash
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			body, _, err := r.store.Store.Get(chunksKeyPrefix + r.chunks[0])
+			if err != nil {
+				return 0, fmt.Errorf("chunk %s : %w", r.chunks[0], err)
+			}
+			r.cur, r.id, r.hash, r.chunks = body, r.chunks[0], sha256.New(), r.chunks[1:]
+		}
+		n, err := r.cur.Read(p)
+		r.hash.Write(p[:n])
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if r.store.hashName(hex.EncodeToString(r.hash.Sum(nil))) != r.id {
+				return n, fmt.Errorf("chunk %s : corrupted content", r.id)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
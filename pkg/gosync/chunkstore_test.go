@@ -0,0 +1,105 @@
+package gosync
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChunkStore(t *testing.T) {
+	src, m := newMemConfig(t)
+	h := &headStore{Store: m}
+	cs := new(ChunkStore).setChunkSizes(h, 64, 256, 1024)
+	data := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(data)
+	src.writeFile("big", string(data))
+	src.writeFile("copy", string(data))
+	src.writeFile("empty", "")
+	state := filepath.Join(t.TempDir(), "state.json")
+	src.SetStore(cs).SetHashMode(HashSHA256).SetStateFile(state).SetMode(ModeBackup)
+	src.run(t)
+	chunks := func() (n int) {
+		for _, k := range m.Keys() {
+			if strings.HasPrefix(k, chunksKeyPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+	n := chunks()
+	if n < 20 || n > 300 {
+		t.Fatalf("unexpected chunk count : %d", n)
+	}
+	if ob, err := cs.Head("/big"); err != nil || ob.Size != 20000 || ob.Meta[metaChunked] != "" {
+		t.Fatalf("unexpected object : %v, %v", ob, err)
+	}
+
+	// unchanged objects are decided from the listing, without heading them
+	atomic.StoreInt64(&h.heads, 0)
+	if r := src.run(t); r.Identical != 3 || h.heads != 0 {
+		t.Fatalf("unexpected report : %v, %d heads", r, h.heads)
+	}
+
+	// an insertion only adds the chunks around it
+	data = append(data[:10000], append([]byte("inserted"), data[10000:]...)...)
+	src.writeFile("big", string(data))
+	if r := src.run(t); r.Uploads != 1 || r.Identical != 2 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	if added := chunks() - n; added < 1 || added > 3 {
+		t.Fatalf("unexpected chunks added : %d", added)
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(cs).SetHashMode(HashSHA256).SetMode(ModeRestore)
+	dst.run(t)
+	if files := dst.listFiles(); !reflect.DeepEqual(files, []string{"big", "copy", "empty"}) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst.prefix, "big")); !bytes.Equal(got, data) {
+		t.Fatal("unexpected content")
+	}
+	if r := dst.run(t); r.Downloads != 0 || r.Identical != 3 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+
+	// copies share the chunks, with or without a Copier base store
+	n = chunks()
+	for i, c := range []Copier{cs, new(ChunkStore).setChunkSizes(m, 64, 256, 1024)} {
+		dst := "/copy" + strconv.Itoa(i)
+		if err := c.Copy("/big", dst); err != nil {
+			t.Fatal(err)
+		}
+		r, ob, err := cs.Get(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, data) || ob.Size != int64(len(data)) || chunks() != n {
+			t.Fatalf("unexpected copy : %v, %v, %d chunks", ob, err, chunks()-n)
+		}
+	}
+
+	// corrupted chunks are detected
+	for _, k := range m.Keys() {
+		if strings.HasPrefix(k, chunksKeyPrefix) {
+			m.Put(k, strings.NewReader("corrupted"), nil)
+		}
+	}
+	r, _, err := cs.Get("/copy")
+	if err == nil {
+		_, err = io.ReadAll(r)
+		r.Close()
+	}
+	if err == nil {
+		t.Fatal("corrupted chunks should be detected")
+	}
+}
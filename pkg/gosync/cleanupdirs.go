@@ -10,9 +10,14 @@ import (
 // Mostly useful after a restore, if file folder was not initially empty.
 // Never called implicitely on backup/restore.
 // Special care is taken to ensure nested empty dirs are also removed.
-func (c *Config) RemoveAllEmptyDirs() {
+// Directories that cannot be read or removed are left in place,
+// and reported in the returned *SyncError.
+func (c *Config) RemoveAllEmptyDirs() error {
 
 	var touched bool = true
+	errs := new(errorList)
+	// failed dirs are not reported twice
+	failed := make(map[string]bool)
 
 	// Iterated as long as we are touching something ...
 	for touched {
@@ -22,36 +27,49 @@ func (c *Config) RemoveAllEmptyDirs() {
 		e2 := filepath.Walk(c.prefix,
 			func(path string, info os.FileInfo, e1 error) error {
 				if e1 != nil {
-					panic(e1)
+					if !failed[path] {
+						failed[path] = true
+						errs.add(OpWalk, path, e1)
+						c.log.Warn("failed", "op", OpWalk, "key", path, "error", e1)
+					}
+					return nil
 				}
 				if path == c.prefix {
 					// don't remove root prefix dir !
 					return nil
 				}
-				if info.IsDir() && c.isEmptyDir(path) {
+				if info.IsDir() && !failed[path] && c.isEmptyDir(path) {
 					e3 := os.Remove(path)
 					if e3 != nil {
-						panic(e3)
+						failed[path] = true
+						errs.add(OpRemoveDir, path, e3)
+						c.log.Warn("failed", "op", OpRemoveDir, "key", path, "error", e3)
+						return nil
 					}
+					c.log.Info(string(OpRemoveDir), "op", OpRemoveDir, "key", path)
 					touched = true
 				}
 				return nil
 			})
 
 		if e2 != nil {
-			panic(e2)
+			errs.add(OpWalk, c.prefix, e2)
+			c.log.Warn("failed", "op", OpWalk, "key", c.prefix, "error", e2)
+			break
 		}
 
 	}
+	return errs.err()
 }
 
 // isEmptyDir test for an empty dir
 // Assuming we already know it is a dir...
+// A directory that cannot be read is not considered empty.
 func (c *Config) isEmptyDir(dirname string) bool {
 
 	f, err := os.Open(dirname)
 	if err != nil {
-		panic(err)
+		return false
 	}
 	defer f.Close()
 
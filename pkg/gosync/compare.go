@@ -0,0 +1,241 @@
+package gosync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HashMode selects how file and object contents are compared.
+type HashMode int
+
+// HashNone compares sizes and times only, as S3 listings provide them for free.
+// HashMD5 compares a local MD5 with the object ETag,
+// using the S3 multipart scheme (md5 of the parts md5, suffixed with -N) for large files.
+// HashSHA256 compares a local SHA-256 with the checksum stored in the object metadata upon upload.
+// When hashing, a file with a different size is still considered different, without hashing.
+const (
+	HashNone HashMode = iota
+	HashMD5
+	HashSHA256
+)
+
+func (h HashMode) String() string {
+	switch h {
+	case HashNone:
+		return "none"
+	case HashMD5:
+		return "md5"
+	case HashSHA256:
+		return "sha256"
+	default:
+		return "invalid(" + strconv.Itoa(int(h)) + ")"
+	}
+}
+
+// Set parses the hash mode, so that it can be used as a flag.
+func (h *HashMode) Set(s string) error {
+	for _, m := range []HashMode{HashNone, HashMD5, HashSHA256} {
+		if m.String() == s {
+			*h = m
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid hash mode %q, use none, md5 or sha256", s)
+}
+
+// Part sizes used by the S3 uploader, see s3manager.
+const (
+	minPartSize    = 5 * 1024 * 1024
+	maxUploadParts = 10000
+)
+
+// same decides if the file content is the same as the object content.
+// Without hashing, times are compared, see sameTime.
+// The object metadata are retrieved if needed.
+// When attributes are preserved, they are compared too.
+// Stored links are compared by target, see sameLink.
+func (c *Config) same(sf SrcFile, ob DstObject) (bool, error) {
+	if ob.Meta == nil && (ob.Size < 0 || ob.Size == 0 && (sf.size != 0 || sf.link != "" || sf.hardlink != "")) {
+		// unknown size, or may be a link object, listings do not provide the metadata
+		h, err := c.store.Head(ob.Key)
+		if err != nil {
+			return false, err
+		}
+		ob = h
+	}
+	if sf.link != "" || sf.hardlink != "" || ob.Meta[metaSymlink] != "" || ob.Meta[metaHardlink] != "" {
+		return c.sameLink(sf, ob), nil
+	}
+	ok, err := c.sameContent(sf.absPath, sf.size, sf.updated, ob)
+	if !ok || err != nil || !c.keepAttrs {
+		return ok, err
+	}
+	if ob.Meta == nil {
+		// listings do not provide the metadata
+		if ob, err = c.store.Head(ob.Key); err != nil {
+			return false, err
+		}
+	}
+	// the owner cannot be restored without being root, see applyOwner
+	return sameAttrs(sf.absPath, ob, c.mode.isBackup() || canChown())
+}
+
+// sameLink checks that a link object matches the file.
+// A stored symbolic link should have the target of the file link.
+// A hard link object is the same as any file linked to its primary file.
+func (c *Config) sameLink(sf SrcFile, ob DstObject) bool {
+	if primary := ob.Meta[metaHardlink]; primary != "" {
+		return sf.link == "" && c.sameHardlink(sf.absPath, primary)
+	}
+	return sf.hardlink == "" && sf.link == ob.Meta[metaSymlink]
+}
+
+// sameContent compares the file and object contents, see same.
+func (c *Config) sameContent(absPath string, size int64, updated time.Time, ob DstObject) (bool, error) {
+	if size != ob.Size {
+		return false, nil
+	}
+	switch c.hashMode {
+	case HashMD5:
+		etag := strings.Trim(ob.ETag, "\"")
+		if etag == "" {
+			return false, nil
+		}
+		local, err := fileETag(absPath, size, etag)
+		return local == etag, err
+	case HashSHA256:
+		if ob.Meta == nil {
+			// listings do not provide the metadata
+			h, err := c.store.Head(ob.Key)
+			if err != nil {
+				return false, err
+			}
+			ob = h
+		}
+		sum, ok := ob.Meta[metaSHA256]
+		if !ok {
+			return false, nil
+		}
+		local, err := fileSHA256(absPath)
+		return local == sum, err
+	default:
+		return c.sameTime(updated, ob)
+	}
+}
+
+// sameTime compares the file modification time with the object.
+// The source modification time stored in the metadata is used when present,
+// and should be equal. Otherwise, the file should not have been modified
+// after the object was updated.
+// When backing up, the object metadata are retrieved only when that rule would fail,
+// a file older than its object being up to date. Restores always compare the stored time,
+// an object updated since the file was written being possibly newer than the file.
+func (c *Config) sameTime(updated time.Time, ob DstObject) (bool, error) {
+	if ob.Meta == nil {
+		if c.mode.isBackup() && !updated.After(ob.Updated) {
+			return true, nil
+		}
+		// listings do not provide the metadata
+		h, err := c.store.Head(ob.Key)
+		if err != nil {
+			return false, err
+		}
+		ob = h
+	}
+	mtime, ok := storedMtime(ob)
+	if !ok {
+		return !updated.After(ob.Updated), nil
+	}
+	return sameMtime(updated, mtime), nil
+}
+
+// sameMtime compares modification times,
+// at the second when one of them has no sub-second part,
+// as some file systems only keep seconds.
+func sameMtime(t1, t2 time.Time) bool {
+	if t1.Equal(t2) {
+		return true
+	}
+	if t1.Nanosecond() == 0 || t2.Nanosecond() == 0 {
+		return t1.Unix() == t2.Unix()
+	}
+	return false
+}
+
+// fileSHA256 computes the hex SHA-256 of a file.
+func fileSHA256(absPath string) (string, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// partSize returns the part size the S3 uploader uses for a file of size bytes.
+func partSize(size int64) int64 {
+	if size/minPartSize >= maxUploadParts {
+		return size/maxUploadParts + 1
+	}
+	return minPartSize
+}
+
+// fileETag computes the ETag S3 would provide for the file,
+// choosing the part size so as to match the number of parts of etag, if possible.
+// It is the plain hex MD5 for files uploaded in a single part.
+func fileETag(absPath string, size int64, etag string) (string, error) {
+	ps := partSize(size)
+	if i := strings.LastIndex(etag, "-"); i >= 0 {
+		n, err := strconv.ParseInt(etag[i+1:], 10, 64)
+		if err == nil && n > 0 && (size+ps-1)/ps != n {
+			// uploaded with another tool, guess the part size,
+			// as the smallest MiB multiple giving the same number of parts.
+			const mib = 1024 * 1024
+			ps = ((size+n-1)/n + mib - 1) / mib * mib
+		}
+	} else {
+		// single part
+		ps = size
+	}
+
+	f, err := os.Open(absPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return multipartETag(f, size, ps)
+}
+
+// multipartETag computes the S3 ETag of a content of size bytes, read from r,
+// uploaded with parts of partSize bytes.
+func multipartETag(r io.Reader, size int64, partSize int64) (string, error) {
+	if size <= partSize {
+		h := md5.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	all := md5.New()
+	parts := 0
+	for left := size; left > 0; left -= partSize {
+		h := md5.New()
+		if _, err := io.CopyN(h, r, partSize); err != nil && err != io.EOF {
+			return "", err
+		}
+		all.Write(h.Sum(nil))
+		parts++
+	}
+	return hex.EncodeToString(all.Sum(nil)) + "-" + strconv.Itoa(parts), nil
+}
@@ -0,0 +1,60 @@
+package gosync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMultipartETag(t *testing.T) {
+	data := []byte("0123456789")
+
+	single := md5.Sum(data)
+	etag, err := multipartETag(bytes.NewReader(data), 10, 10)
+	if err != nil || etag != hex.EncodeToString(single[:]) {
+		t.Fatalf("unexpected single part etag : %s, %v", etag, err)
+	}
+
+	// 3 parts, 4+4+2 bytes
+	all := md5.New()
+	for _, p := range [][]byte{data[:4], data[4:8], data[8:]} {
+		s := md5.Sum(p)
+		all.Write(s[:])
+	}
+	want := hex.EncodeToString(all.Sum(nil)) + "-3"
+	etag, err = multipartETag(bytes.NewReader(data), 10, 4)
+	if err != nil || etag != want {
+		t.Fatalf("unexpected multipart etag : %s, expected %s, %v", etag, want, err)
+	}
+}
+
+func TestHashModes(t *testing.T) {
+	for _, h := range []HashMode{HashMD5, HashSHA256} {
+		c, m := newMemConfig(t)
+		c.createContent()
+		c.SetHashMode(h).SetMode(ModeBackup)
+		c.run(t)
+
+		// touching a file does not upload it again
+		future := time.Now().Add(time.Hour)
+		os.Chtimes(filepath.Join(c.prefix, "a", "one"), future, future)
+		r := c.run(t)
+		if r.Uploads != 0 {
+			t.Fatalf("%v : touched file should not be uploaded : %v", h, r)
+		}
+
+		// same size edit, with a preserved old mtime, is detected
+		past := time.Now().Add(-time.Hour)
+		c.writeFile("a/one", "ONE")
+		os.Chtimes(filepath.Join(c.prefix, "a", "one"), past, past)
+		r = c.run(t)
+		if r.Uploads != 1 {
+			t.Fatalf("%v : edited file should be uploaded : %v", h, r)
+		}
+		c.checkStoreContent(t, m)
+	}
+}
@@ -4,15 +4,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 // Config defines the configuration and context for a sync operation.
@@ -22,8 +21,13 @@ type Config struct {
 	// prefix to define the root of the file system to consider
 	// also added to s3 keys to retrieve the absolute path.
 	prefix string
+	// key prefix, scoping the keys inside the bucket.
+	// If not empty, it ends with a slash.
+	keyPrefix string
 	// aws region
 	region string
+	// local destination directory, used instead of the bucket if set.
+	dest string
 	// max key length - 1024 as per aws documentation
 	maxKeyLength int
 
@@ -34,20 +38,79 @@ type Config struct {
 	// permission mode used for creating intermediate directories.
 	dirPerm os.FileMode
 
-	// S3 session
-	sess *session.Session
-	// S3 client
-	s3 *s3.S3
-
-	// Channel for processing source files
+	// gitignore-style include and exclude patterns,
+	// and name of the per directory ignore files.
+	includes   []string
+	excludes   []string
+	ignoreFile string
+	// filter of the current run
+	filter *filter
+	// first path walked of the files having several hard links, in the current run.
+	inodes map[inode]string
+	// hard links to create at the end of the current run.
+	relinks *linkQueue
+
+	// how file and object contents are compared
+	hashMode HashMode
+	// preserve file mode, ownership and extended attributes ?
+	keepAttrs bool
+	// how symbolic links are synchronized
+	symlinks SymlinkPolicy
+	// how conflicts are resolved, in the bidirectional modes
+	conflicts ConflictPolicy
+	// never delete files or objects, in any mode
+	noDelete bool
+	// maximum deletions per run, and files and objects compared by the current run
+	maxDeletions DeletionLimit
+	compared     int
+	// move the deleted files and objects to the trash, see SetTrash,
+	// local trash directory, and id of the current run.
+	trash    bool
+	trashDir string
+	runID    string
+	// point in time, or snapshot, to restore, see SetAsOf and SetSnapshot.
+	asOf       time.Time
+	snapshotID string
+
+	// local state file, none if empty, and should it be rebuilt ?
+	stateFile string
+	rescan    bool
+	// state loaded from the state file
+	state *stateCache
+
+	// destination object store
+	store Store
+
+	// Channel for the walked source files
 	files chan SrcFile
-	// Channel for processing S3 objects
+	// Channel for the listed S3 objects
 	objects chan DstObject
+	// failures of the current run
+	errs *errorList
+	// report of the current run
+	report *Report
+	// print the report as JSON ?
+	jsonReport bool
+
+	// logger, and level of the default logger
+	log   *slog.Logger
+	level *slog.LevelVar
 }
 
 func (c *Config) String() string {
-	s := fmt.Sprintf("Configuration :\n\tMode:\t%s\n\tBucket:\t%s\n\tPrefix:\t%s\n\tRegion:\t%s\n",
-		c.mode.String(), c.bucket, c.prefix, c.region)
+	s := fmt.Sprintf("Configuration :\n\tMode:\t%s\n\tStore:\t%v\n\tKeys:\t%s\n\tPrefix:\t%s\n\tRegion:\t%s\n",
+		c.mode.String(), c.store, c.keyPrefix, c.prefix, c.region)
+	if !c.asOf.IsZero() {
+		s += "\tAs of:\t" + c.asOf.Format(time.RFC3339) + "\n"
+	}
+	if c.snapshotID != "" {
+		s += "\tSnapshot:\t" + c.snapshotID + "\n"
+	}
+	if !c.deletes() {
+		s += "\tDeletions:\tdisabled\n"
+	} else if l := c.maxDeletions.String(); l != "" {
+		s += "\tDeletions:\tat most " + l + "\n"
+	}
 	return s
 }
 
@@ -56,7 +119,14 @@ func (c *Config) String() string {
 type SrcFile struct {
 	absPath string
 	updated time.Time
-	size    int64
+	// status change time, zero when unknown.
+	ctime time.Time
+	size  int64
+	// target of the link, when the link itself is stored, see SymlinkStore.
+	link string
+	// slash separated path, relative to the prefix,
+	// of the first file walked with the same inode, if any.
+	hardlink string
 }
 
 func (s *SrcFile) String() string {
@@ -64,47 +134,56 @@ func (s *SrcFile) String() string {
 	return res
 }
 
-// getKey remove the efix from the absPath of a SrcFile.
+// getKey remove the efix from the absPath of a SrcFile,
+// replacing it with the key prefix, if any.
+// Without a key prefix, keys start with a slash.
 // Return empty key if prefix does not match.
 func (c *Config) getKey(s SrcFile) string {
 	if !strings.HasPrefix(s.absPath, c.prefix) {
 		return ""
 	}
-	return s.absPath[len(c.prefix):]
+	rel := filepath.ToSlash(s.absPath[len(c.prefix):])
+	if c.keyPrefix == "" {
+		return rel
+	}
+	return c.keyPrefix + strings.TrimPrefix(rel, "/")
 }
 
-// DstObject describes the S3 object in the target bucket.
+// DstObject describes the object in the destination Store.
+// Fields are exported so that Store implementations can fill them.
 type DstObject struct {
-	key     string
-	updated time.Time
-	size    int64
+	Key     string
+	Updated time.Time
+	// Size of the content, negative when unknown, as in the listings of a ChunkStore.
+	Size int64
+	// ETag as provided by the store, possibly empty.
+	ETag string
+	// Meta are the user metadata, with lower case keys.
+	// They are nil when unknown, as in listings.
+	Meta map[string]string
 }
 
 func (o *DstObject) String() string {
-	res := fmt.Sprintf("[%v]\t%d bytes\t%s", o.updated, o.size, o.key)
+	res := fmt.Sprintf("[%v]\t%d bytes\t%s", o.Updated, o.Size, o.Key)
 	return res
 }
 
 // getAbsPath constructs the absolute path equivalent.
-func (o *DstObject) getAbsPath(c *Config) string {
-	res := path.Join(c.prefix, o.key)
+// It fails for keys outside of the key prefix,
+// or that would point outside of the prefix directory.
+func (o *DstObject) getAbsPath(c *Config) (string, error) {
+	if !strings.HasPrefix(o.Key, c.keyPrefix) {
+		return "", errors.New("key does not start with the key prefix " + c.keyPrefix)
+	}
+	res := filepath.Join(c.prefix, filepath.FromSlash(o.Key[len(c.keyPrefix):]))
 	res, err := filepath.Abs(res)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return res
-}
-
-// dstObjectFromS3Object return a DstObject from an s3.Object
-func (c *Config) dstObjectFromS3Object(o *s3.Object) DstObject {
-	if o == nil {
-		panic(errors.New("cannot process a nil s3.object"))
+	if !isSubDir(c.prefix, res) || res == c.prefix {
+		return "", errors.New("key does not designate a file inside the prefix directory")
 	}
-	d := DstObject{}
-	d.key = *o.Key
-	d.updated = o.LastModified.UTC()
-	d.size = *o.Size
-	return d
+	return res, nil
 }
 
 // NewConfig creates a new configuration,
@@ -126,8 +205,71 @@ func NewConfig() *Config {
 
 	flag.StringVar(&c.region, "region", c.region, "the AWS region to use")
 
+	flag.StringVar(&c.keyPrefix, "key-prefix", c.keyPrefix, "the key prefix in the bucket, such as hosts/laptop1/home/ - the whole bucket is used by default")
+	flag.StringVar(&c.keyPrefix, "k", c.keyPrefix, "the key prefix in the bucket, such as hosts/laptop1/home/ - the whole bucket is used by default")
+
+	flag.StringVar(&c.dest, "dest", c.dest, "a local directory used as destination, instead of the s3 bucket")
+
+	flag.Var((*stringList)(&c.excludes), "exclude", "gitignore-style pattern of the files or directories to exclude, can be repeated")
+	flag.Var((*stringList)(&c.includes), "include", "gitignore-style pattern of the only files to include, can be repeated")
+	flag.StringVar(&c.ignoreFile, "ignore-file", c.ignoreFile, "name of the per directory ignore files, none if empty")
+
+	flag.Var(&c.hashMode, "hash", "compare contents with hashes : none (size and time only), md5 (with the ETag) or sha256 (with a stored checksum)")
+
+	flag.BoolVar(&c.keepAttrs, "meta", c.keepAttrs, "also preserve file mode, ownership and extended attributes")
+
+	flag.Var(&c.symlinks, "symlinks", "how symbolic links are synchronized : follow (the target), skip, or store (the link itself)")
+
+	cache := flag.Bool("cache", false, "use a local state cache, in the user cache directory, to avoid a request per file")
+	flag.StringVar(&c.stateFile, "state", c.stateFile, "the local state cache file, see -cache")
+	flag.BoolVar(&c.rescan, "rescan", c.rescan, "rebuild the local state cache, comparing every file again")
+
+	flag.Var(&c.conflicts, "conflict", "how bidirectional sync resolves conflicts : keep-newer, keep-both (renaming the file with a conflict suffix) or abort")
+
+	flag.BoolVar(&c.noDelete, "no-delete", c.noDelete, "never delete files or objects, only add or update them")
+
+	flag.Var(&c.maxDeletions, "max-delete", "abort the run, before any action, if it would delete more files or objects than this number, or percentage, such as 100 or 10%")
+
+	flag.BoolVar(&c.trash, "trash", c.trash, "move the deleted files to the trash directory, and the deleted objects under the trash/ key prefix, instead of deleting them")
+	flag.StringVar(&c.trashDir, "trash-dir", c.trashDir, "the local trash directory, outside of the prefix - a sibling of the prefix by default")
+
+	asOf := flag.String("as-of", "", "restore the files as they were at that time, from a versioned bucket, such as 2020-01-02T15:04:05Z")
+
+	flag.StringVar(&c.snapshotID, "snapshot", c.snapshotID, "restore the files of that snapshot id, or of the latest snapshot")
+
+	chunks := flag.Bool("chunks", false, "store the files as deduplicated chunks, so that only the changed parts are uploaded - use with -hash sha256")
+
+	encrypt := flag.Bool("encrypt", false, "encrypt the contents and metadata, with a key derived from the "+EnvPassphrase+" environment variable - use with -hash sha256")
+	keyFile := flag.String("key-file", "", "encrypt with a key derived from this file, of at least 32 random bytes, instead of a passphrase")
+	encryptKeys := flag.Bool("encrypt-keys", false, "also encrypt the object keys, hiding the file paths, with -encrypt or -key-file")
+
+	flag.BoolVar(&c.jsonReport, "json", c.jsonReport, "print the final report as JSON")
+
+	quiet := flag.Bool("q", false, "quiet, only log failures")
+	verbose := flag.Bool("v", false, "verbose, also log the files found identical")
+	debug := flag.Bool("debug", false, "log everything, including internal processing steps")
+
 	flag.Parse()
 
+	c.SetKeyPrefix(c.keyPrefix)
+	if *asOf != "" {
+		t, err := parseTime(*asOf)
+		if err != nil {
+			fmt.Println("The provided -as-of time is invalid : ", *asOf)
+			panic(err)
+		}
+		c.asOf = t
+	}
+
+	switch {
+	case *debug:
+		c.level.Set(LevelTrace)
+	case *verbose:
+		c.level.Set(slog.LevelDebug)
+	case *quiet:
+		c.level.Set(slog.LevelWarn)
+	}
+
 	ap, err := filepath.Abs(c.prefix)
 	if err != nil {
 		fmt.Println("The provided prefix is invalid and could not be translated into an absolute path : ", c.prefix)
@@ -135,13 +277,44 @@ func NewConfig() *Config {
 	} else {
 		c.prefix = ap
 	}
+
+	if c.dest == "" {
+		// bucket or region may have changed
+		c.store = c.newS3Store()
+	} else {
+		ad, err := filepath.Abs(c.dest)
+		if err != nil {
+			fmt.Println("The provided destination is invalid and could not be translated into an absolute path : ", c.dest)
+			panic(err)
+		}
+		if isSubDir(ap, ad) || isSubDir(ad, ap) {
+			panic("the destination and the prefix directories should not contain each other : " + ad)
+		}
+		c.dest = ad
+		c.store = NewDirStore(c.dest).setPerm(c.dirPerm)
+	}
+	if *encrypt || *keyFile != "" {
+		key, err := encryptionKey(c.store, *keyFile)
+		if err != nil {
+			fmt.Println("The encryption key is unavailable : ", err)
+			panic(err)
+		}
+		cs, err := NewCryptStore(c.store, key, *encryptKeys)
+		if err != nil {
+			panic(err)
+		}
+		c.store = cs
+	}
+	if *chunks {
+		c.store = NewChunkStore(c.store)
+	}
+	c.setDefaultStateFile(*cache)
 	return c
 
 }
 
 // NewDefaultConfig provides a default configuration
 func NewDefaultConfig() *Config {
-	var err error
 
 	c := new(Config)
 	c.bucket = "test.gandillot.com"
@@ -151,31 +324,205 @@ func NewDefaultConfig() *Config {
 
 	c.mode = ModeBackupMock
 	c.dirPerm = 0o_0777 // all permissions to anyone ...
+	c.ignoreFile = DefaultIgnoreFile
+
+	c.level = new(slog.LevelVar) // defaults to info
+	c.log = newLogger(os.Stderr, c.level)
+
+	c.store = c.newS3Store()
+
+	return c
+}
 
-	c.sess, err = session.NewSession(
+// isSubDir checks if the absolute path sub is dir, or inside dir.
+func isSubDir(dir, sub string) bool {
+	rel, err := filepath.Rel(dir, sub)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// newS3Store creates the S3 Store for the configured bucket and region.
+func (c *Config) newS3Store() Store {
+	sess, err := session.NewSession(
 		&aws.Config{
 			Region: aws.String(c.region),
 		})
 	if err != nil {
 		panic(err)
 	}
+	return NewS3Store(sess, c.bucket)
+}
 
-	c.s3 = s3.New(c.sess)
+// SetMode sets the mode for the sync operation (backup or restore)
+func (c *Config) SetMode(m Mode) *Config {
+	c.mode = m
+	return c
+}
 
-	c.files = make(chan SrcFile, 2000)
-	c.objects = make(chan DstObject, 2000)
+// SetKeyPrefix scopes all the keys, and the listing, to keyPrefix.
+// It lets multiple trees share one bucket safely.
+// A trailing slash is added, and the leading one removed, if needed.
+// An empty key prefix uses the whole bucket.
+func (c *Config) SetKeyPrefix(keyPrefix string) *Config {
+	keyPrefix = strings.TrimLeft(keyPrefix, "/")
+	if keyPrefix != "" && !strings.HasSuffix(keyPrefix, "/") {
+		keyPrefix += "/"
+	}
+	c.keyPrefix = keyPrefix
+	return c
+}
 
+// AddExclude adds gitignore-style patterns of files or directories to exclude.
+// The ignore files take precedence over these patterns.
+func (c *Config) AddExclude(patterns ...string) *Config {
+	c.excludes = append(c.excludes, patterns...)
 	return c
 }
 
-// SetMode sets the mode for the sync operation (backup or restore)
-func (c *Config) SetMode(m Mode) *Config {
-	c.mode = m
+// AddInclude adds gitignore-style patterns of files to include.
+// Once set, only the files matching one of them are synchronized.
+func (c *Config) AddInclude(patterns ...string) *Config {
+	c.includes = append(c.includes, patterns...)
 	return c
 }
 
+// SetIgnoreFile sets the name of the per directory ignore files,
+// DefaultIgnoreFile by default. An empty name disables them.
+func (c *Config) SetIgnoreFile(name string) *Config {
+	c.ignoreFile = name
+	return c
+}
+
+// SetHashMode sets how file and object contents are compared.
+func (c *Config) SetHashMode(h HashMode) *Config {
+	c.hashMode = h
+	return c
+}
+
+// SetKeepAttrs preserves the file mode, ownership and extended attributes,
+// stored as object metadata upon upload, and applied upon download.
+// Ownership is only restored when running as root.
+func (c *Config) SetKeepAttrs(keep bool) *Config {
+	c.keepAttrs = keep
+	return c
+}
+
+// SetSymlinkPolicy sets how symbolic links are synchronized, SymlinkFollow by default.
+func (c *Config) SetSymlinkPolicy(p SymlinkPolicy) *Config {
+	c.symlinks = p
+	return c
+}
+
+// SetStateFile sets the local state cache file, none by default.
+// The cache records the files found identical to their object,
+// so that the next runs skip them, without comparing them again.
+// An empty path disables the cache.
+func (c *Config) SetStateFile(path string) *Config {
+	c.stateFile = path
+	c.state = nil
+	return c
+}
+
+// SetRescan ignores the content of the state file, that is rebuilt.
+func (c *Config) SetRescan(rescan bool) *Config {
+	c.rescan = rescan
+	c.state = nil
+	return c
+}
+
+// setDefaultStateFile uses the default state file, if requested and none was set.
+func (c *Config) setDefaultStateFile(cache bool) {
+	if !cache || c.stateFile != "" {
+		return
+	}
+	p, err := c.defaultStateFile()
+	if err != nil {
+		fmt.Println("The state cache cannot be used : ", err)
+		panic(err)
+	}
+	c.stateFile = p
+}
+
+// SetConflictPolicy sets how the bidirectional modes resolve conflicts,
+// ConflictKeepNewer by default.
+func (c *Config) SetConflictPolicy(p ConflictPolicy) *Config {
+	c.conflicts = p
+	return c
+}
+
+// SetNoDelete disables all the deletions, in any mode,
+// so that missing files or objects are never propagated.
+func (c *Config) SetNoDelete(noDelete bool) *Config {
+	c.noDelete = noDelete
+	return c
+}
+
+// SetMaxDeletions sets the maximum deletions per run.
+// A run planning more deletions aborts before any action,
+// reporting the deletions as failed.
+func (c *Config) SetMaxDeletions(l DeletionLimit) *Config {
+	c.maxDeletions = l
+	return c
+}
+
+// SetTrash moves the deleted files and objects to the trash, instead of deleting them.
+// Files are moved to <trash dir>/<run id>/<path>, see SetTrashDir,
+// and objects to trash/<run id>/<key>, at the root of the bucket.
+// The run id is the UTC start time of the run. See PurgeTrash.
+func (c *Config) SetTrash(trash bool) *Config {
+	c.trash = trash
+	return c
+}
+
+// SetTrashDir sets the local trash directory, outside of the prefix directory.
+// By default, it is a sibling of the prefix directory, named .<prefix name>.trash.
+func (c *Config) SetTrashDir(dir string) *Config {
+	c.trashDir = dir
+	return c
+}
+
+// SetAsOf restores the files as they were at a point in time, from a VersionedStore.
+// Each object is restored in its last version before t, and the objects
+// deleted then, or created later, are ignored. Only the restore modes can be used,
+// the store being read only. The zero time restores the latest versions.
+func (c *Config) SetAsOf(t time.Time) *Config {
+	c.asOf = t
+	return c
+}
+
+// SetSnapshot restores the files of a snapshot, see Config.Snapshot, designated
+// by its id, or "latest". The snapshot is restored exactly, the files
+// missing from it being deleted, unless deletions are disabled.
+// Only the restore modes can be used, the store being read only.
+func (c *Config) SetSnapshot(id string) *Config {
+	c.snapshotID = id
+	return c
+}
+
+// deletes is true unless the deletions are disabled, see SetNoDelete and ModeUploadOnly.
+func (c *Config) deletes() bool {
+	return !c.noDelete && !c.mode.isAdditive()
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 // SetPerm sets the permission (FileMode) to use when creating missing directories.
 func (c *Config) SetPerm(dirPermission os.FileMode) *Config {
 	c.dirPerm = dirPermission
 	return c
 }
+
+// SetStore sets the destination Store, replacing the default S3 bucket.
+func (c *Config) SetStore(s Store) *Config {
+	c.store = s
+	return c
+}
@@ -0,0 +1,508 @@
+package gosync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// CryptStore is a Store adapter encrypting the object contents, and metadata,
+// and optionally the keys, so that the base store only holds encrypted data.
+//
+// Contents are encrypted with AES-256-GCM, in segments of cryptSegment bytes,
+// each authenticated with its position, whether it is the last one, and the object key,
+// with a random key per object, derived from the store key and a random salt.
+// The metadata are stored encrypted in the metaCrypt metadata, with that salt,
+// and authenticated with the object key.
+// Reordered, truncated, modified or swapped contents fail to be read.
+//
+// Keys are encrypted deterministically, each path element separately,
+// so that listing a prefix made of whole path elements still works,
+// and that a file always has the same object. Equal path elements can be recognized,
+// but not read. Keys that cannot be decrypted are not listed.
+//
+// The chunks, and the snapshot contents, are named by a hash keyed with the store key, see hashName.
+//
+// The ETag is the one of the encrypted content : use the sha256 hash mode to compare contents.
+// As the contents are bound to their key, CryptStore is not a Copier : the trashed objects
+// are downloaded and uploaded again, see trashObject. The chunk lists only, with a ChunkStore.
+type CryptStore struct {
+	Store
+	// metadata, and key names
+	meta, names cipher.AEAD
+	// keys of the per object content keys, of the key name nonces, and of the content names
+	objectKey, nonceKey, nameKey []byte
+	encryptKeys                  bool
+}
+
+// metaCrypt is the metadata holding the encrypted metadata, see CryptStore.
+const metaCrypt = "crypt"
+
+// cryptMeta is the content of the metaCrypt metadata, once decrypted.
+type cryptMeta struct {
+	// Salt is the salt of the content key, that should match the one of the content.
+	Salt []byte            `json:"salt"`
+	Meta map[string]string `json:"meta"`
+}
+
+const (
+	// cryptVersion is the first byte of the encrypted contents.
+	cryptVersion = 1
+	// cryptSaltSize is the size of the per object salt, following the version.
+	cryptSaltSize = 16
+	cryptHeader   = 1 + cryptSaltSize
+	// cryptSegment is the size of the content segments, each followed by its tag.
+	cryptSegment = 64 << 10
+	cryptTag     = 16
+)
+
+// EnvPassphrase is the environment variable providing the passphrase, see the -encrypt flag.
+const EnvPassphrase = "GOSYNC_PASSPHRASE"
+
+// NewCryptStore creates an encrypting adapter of the base store, with a 32 bytes key,
+// see PassphraseKey and ReadKeyFile. If encryptKeys is set, the keys are encrypted too.
+func NewCryptStore(base Store, key []byte, encryptKeys bool) (*CryptStore, error) {
+	if len(key) != 32 {
+		return nil, errors.New("the encryption key should be 32 bytes long")
+	}
+	s := &CryptStore{Store: base, encryptKeys: encryptKeys}
+	var err error
+	if s.meta, err = newGCM(subKey(key, "meta")); err != nil {
+		return nil, err
+	}
+	if s.names, err = newGCM(subKey(key, "names")); err != nil {
+		return nil, err
+	}
+	s.objectKey, s.nonceKey, s.nameKey = subKey(key, "object"), subKey(key, "nonce"), subKey(key, "content name")
+	return s, nil
+}
+
+func (s *CryptStore) String() string {
+	return fmt.Sprintf("%v (encrypted)", s.Store)
+}
+
+// subKey derives the key of a given use from the store key.
+func subKey(key []byte, use string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(use))
+	return h.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// passphraseIterations parameters PassphraseKey.
+const passphraseIterations = 600000
+
+// cryptSaltKey is the key of the random salt of the passphrase keys, at the root of the bucket,
+// stored as is, so that every machine derives the same key, see PassphraseKey.
+const cryptSaltKey = "crypt.salt"
+
+// PassphraseKey derives a store key from a passphrase, with PBKDF2-HMAC-SHA256,
+// and the random salt of the base store, created by the first call,
+// so that the keys of every store cannot be precomputed at once.
+func PassphraseKey(base Store, passphrase string) ([]byte, error) {
+	salt, err := storeSalt(base)
+	if err != nil {
+		return nil, err
+	}
+	return pbkdf2([]byte(passphrase), salt, passphraseIterations), nil
+}
+
+// saltDelay is the delay before reading back a created salt, see storeSalt.
+var saltDelay = 5 * time.Second
+
+// storeSalt reads the salt of the store, creating it if missing.
+// A created salt is read back after saltDelay, and the call fails if another run
+// replaced it meanwhile, as the runs that found it missing at the same time store different salts.
+// The run that stores its salt last is not warned, if it stores it later than the delay
+// after finding it missing, which the delay makes unlikely.
+func storeSalt(s Store) ([]byte, error) {
+	salt, err := readSalt(s)
+	if !errors.Is(err, ErrNotFound) {
+		return salt, err
+	}
+	salt = make([]byte, cryptSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err = s.Put(cryptSaltKey, bytes.NewReader(salt), nil); err != nil {
+		return nil, err
+	}
+	time.Sleep(saltDelay)
+	stored, err := readSalt(s)
+	if err == nil && !bytes.Equal(stored, salt) {
+		err = errors.New("the salt was created concurrently by another run, retry : " + cryptSaltKey)
+	}
+	return stored, err
+}
+
+// readSalt reads the salt of the store, or returns ErrNotFound.
+func readSalt(s Store) ([]byte, error) {
+	r, _, err := s.Get(cryptSaltKey)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	salt, err := io.ReadAll(r)
+	if err == nil && len(salt) < cryptSaltSize {
+		err = errors.New("invalid salt : " + cryptSaltKey)
+	}
+	return salt, err
+}
+
+// pbkdf2 computes the first block of PBKDF2-HMAC-SHA256, 32 bytes.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	h := hmac.New(sha256.New, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// ReadKeyFile derives a store key from a key file, holding at least 32 random bytes.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 32 {
+		return nil, errors.New("the key file should hold at least 32 bytes : " + path)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// encryptionKey returns the key of the base store, from the key file, if any,
+// or from the passphrase in the EnvPassphrase environment variable.
+func encryptionKey(base Store, keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return ReadKeyFile(keyFile)
+	}
+	passphrase := os.Getenv(EnvPassphrase)
+	if passphrase == "" {
+		return nil, errors.New("no key file, and no passphrase in the " + EnvPassphrase + " environment variable")
+	}
+	return PassphraseKey(base, passphrase)
+}
+
+// encryptKey encrypts each element of the key, using a nonce derived from it.
+func (s *CryptStore) encryptKey(key string) string {
+	if !s.encryptKeys {
+		return key
+	}
+	elems := strings.Split(key, "/")
+	for i, e := range elems {
+		if e == "" {
+			continue
+		}
+		h := hmac.New(sha256.New, s.nonceKey)
+		h.Write([]byte(e))
+		nonce := h.Sum(nil)[:s.names.NonceSize()]
+		elems[i] = base64.RawURLEncoding.EncodeToString(s.names.Seal(nonce, nonce, []byte(e), nil))
+	}
+	return strings.Join(elems, "/")
+}
+
+// decryptKey decrypts the elements of a key, checking their nonces.
+func (s *CryptStore) decryptKey(key string) (string, error) {
+	if !s.encryptKeys {
+		return key, nil
+	}
+	elems := strings.Split(key, "/")
+	for i, e := range elems {
+		if e == "" {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(e)
+		if err != nil || len(data) < s.names.NonceSize() {
+			return "", errors.New("invalid encrypted key")
+		}
+		nonce := data[:s.names.NonceSize()]
+		plain, err := s.names.Open(nil, nonce, data[len(nonce):], nil)
+		if err != nil {
+			return "", err
+		}
+		h := hmac.New(sha256.New, s.nonceKey)
+		h.Write(plain)
+		if !hmac.Equal(h.Sum(nil)[:len(nonce)], nonce) {
+			return "", errors.New("invalid encrypted key")
+		}
+		elems[i] = string(plain)
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// hashName keys the names of the contents with the store key,
+// so that the stored chunks and snapshot contents do not reveal their hash, see nameHasher.
+func (s *CryptStore) hashName(sum string) string {
+	h := hmac.New(sha256.New, s.nameKey)
+	h.Write([]byte(sum))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// plainSize returns the size of a content, from its encrypted size.
+func plainSize(size int64) int64 {
+	n := size - cryptHeader
+	segments := (n + cryptSegment + cryptTag - 1) / (cryptSegment + cryptTag)
+	return n - segments*cryptTag
+}
+
+// object decrypts the description of an object, returning the salt of its content, if known.
+func (s *CryptStore) object(ob DstObject) (DstObject, []byte, error) {
+	key, err := s.decryptKey(ob.Key)
+	if err != nil {
+		return ob, nil, err
+	}
+	ob.Key, ob.Size = key, plainSize(ob.Size)
+	if ob.Meta == nil {
+		return ob, nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(ob.Meta[metaCrypt])
+	if err != nil || len(data) < s.meta.NonceSize() {
+		return ob, nil, errors.New("invalid encrypted metadata")
+	}
+	nonce := data[:s.meta.NonceSize()]
+	if data, err = s.meta.Open(nil, nonce, data[len(nonce):], []byte(ob.Key)); err != nil {
+		return ob, nil, err
+	}
+	var m cryptMeta
+	if err = json.Unmarshal(data, &m); err != nil {
+		return ob, nil, err
+	}
+	ob.Meta = m.Meta
+	return ob, m.Salt, nil
+}
+
+// List lists the objects, with their keys decrypted, but those not encrypted with the store key,
+// and the salt of the passphrase keys.
+// With encrypted keys, the last element of the prefix is matched as a whole,
+// as a directory, or as the key of an object.
+func (s *CryptStore) List(prefix string, fn func(DstObject) error) error {
+	return s.Store.List(s.encryptKey(prefix), func(ob DstObject) error {
+		if ob.Key == cryptSaltKey {
+			return nil
+		}
+		ob, _, err := s.object(ob)
+		if err != nil || !strings.HasPrefix(ob.Key, prefix) {
+			return nil
+		}
+		return fn(ob)
+	})
+}
+
+func (s *CryptStore) Head(key string) (DstObject, error) {
+	ob, err := s.Store.Head(s.encryptKey(key))
+	if err != nil {
+		return ob, err
+	}
+	if ob, _, err = s.object(ob); err != nil {
+		return ob, fmt.Errorf("%s : %w", key, err)
+	}
+	return ob, nil
+}
+
+// Get decrypts the content while read. The read fails if it was modified,
+// and Get fails if it is not the content of that object.
+func (s *CryptStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	r, ob, err := s.Store.Get(s.encryptKey(key))
+	if err != nil {
+		return r, ob, err
+	}
+	var salt []byte
+	if ob, salt, err = s.object(ob); err != nil {
+		r.Close()
+		return nil, ob, fmt.Errorf("%s : %w", key, err)
+	}
+	dr := &decryptReader{body: r, r: bufio.NewReaderSize(r, cryptSegment+cryptTag), ad: []byte(key)}
+	header := make([]byte, cryptHeader)
+	if _, err = io.ReadFull(dr.r, header); err != nil || header[0] != cryptVersion || !hmac.Equal(header[1:], salt) {
+		r.Close()
+		return nil, ob, fmt.Errorf("%s : invalid encrypted content", key)
+	}
+	if dr.aead, err = newGCM(subKey(s.objectKey, string(salt))); err != nil {
+		r.Close()
+		return nil, ob, err
+	}
+	return dr, ob, nil
+}
+
+// Put encrypts the content while uploaded, and the metadata, with the salt of the content.
+func (s *CryptStore) Put(key string, r io.Reader, meta map[string]string) error {
+	header := make([]byte, cryptHeader)
+	header[0] = cryptVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cryptMeta{Salt: header[1:], Meta: meta})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.meta.NonceSize(), s.meta.NonceSize()+len(data)+cryptTag)
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := base64.StdEncoding.EncodeToString(s.meta.Seal(nonce, nonce, data, []byte(key)))
+
+	er := &encryptReader{r: r, out: header, ad: []byte(key)}
+	if er.aead, err = newGCM(subKey(s.objectKey, string(header[1:]))); err != nil {
+		return err
+	}
+	return s.Store.Put(s.encryptKey(key), er, map[string]string{metaCrypt: sealed})
+}
+
+func (s *CryptStore) Delete(key string) error {
+	return s.Store.Delete(s.encryptKey(key))
+}
+
+// segmentNonce is the nonce of a content segment, from its position,
+// and whether it is the last one. The segments are authenticated with the object key.
+func segmentNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader encrypts r, segment by segment, reading one segment ahead to find the last one.
+type encryptReader struct {
+	aead cipher.AEAD
+	// additional data, the object key
+	ad []byte
+	r  io.Reader
+	// next segment read, if any
+	next []byte
+	n    uint64
+	// encrypted data not read yet
+	out  []byte
+	done bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next segment.
+func (e *encryptReader) seal() error {
+	if e.next == nil {
+		seg, err := e.read()
+		if err != nil {
+			return err
+		}
+		e.next = seg
+	}
+	seg := e.next
+	next, err := e.read()
+	if err != nil {
+		return err
+	}
+	last := len(seg) < cryptSegment || len(next) == 0
+	e.out = e.aead.Seal(e.out[:0], segmentNonce(e.n, last), seg, e.ad)
+	e.n++
+	e.next, e.done = next, last
+	return nil
+}
+
+// read reads a segment, shorter only at the end.
+func (e *encryptReader) read() ([]byte, error) {
+	seg := make([]byte, cryptSegment)
+	n, err := io.ReadFull(e.r, seg)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return seg[:n], err
+}
+
+// decryptReader decrypts the segments of a content.
+type decryptReader struct {
+	aead cipher.AEAD
+	// additional data, the object key
+	ad   []byte
+	body io.Closer
+	r    *bufio.Reader
+	n    uint64
+	// decrypted data not read yet
+	out  []byte
+	done bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// open decrypts the next segment, the last one being followed by nothing.
+func (d *decryptReader) open() error {
+	seg := make([]byte, cryptSegment+cryptTag)
+	n, err := io.ReadFull(d.r, seg)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = d.r.Peek(1)
+	last := err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+	if d.out, err = d.aead.Open(seg[:0], segmentNonce(d.n, last), seg[:n], d.ad); err != nil {
+		return errors.New("invalid encrypted content")
+	}
+	d.n++
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.body.Close()
+}
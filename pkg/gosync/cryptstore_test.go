@@ -0,0 +1,194 @@
+package gosync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCryptStore(t *testing.T) {
+	// RFC 7914 test vector
+	if k := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1)); !strings.HasPrefix(k, "55ac046e56e3089fec1691c22544b605") {
+		t.Fatalf("unexpected pbkdf2 : %s", k)
+	}
+
+	defer func(d time.Duration) { saltDelay = d }(saltDelay)
+	saltDelay = 0
+
+	// passphrase keys are salted by store
+	m1, m2 := NewMemStore(), NewMemStore()
+	k1, err1 := PassphraseKey(m1, "passphrase")
+	k2, err2 := PassphraseKey(m1, "passphrase")
+	k3, err3 := PassphraseKey(m2, "passphrase")
+	if err1 != nil || err2 != nil || err3 != nil || !bytes.Equal(k1, k2) || bytes.Equal(k1, k3) {
+		t.Fatalf("unexpected keys : %v, %v, %v", err1, err2, err3)
+	}
+	if keys := m1.Keys(); !reflect.DeepEqual(keys, []string{cryptSaltKey}) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+	// a salt created concurrently is detected
+	rs := raceStore{NewMemStore()}
+	if _, err := PassphraseKey(rs, "passphrase"); err == nil {
+		t.Fatal("a concurrent salt should be detected")
+	}
+	if _, err := PassphraseKey(rs, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+
+	src, m := newMemConfig(t)
+	cs, err := NewCryptStore(m, bytes.Repeat([]byte{1}, 32), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.createContent()
+	big := make([]byte, 2*cryptSegment+5)
+	rand.New(rand.NewSource(1)).Read(big)
+	src.writeFile("big", string(big))
+	src.SetStore(cs).SetHashMode(HashSHA256).SetMode(ModeBackup)
+	src.run(t)
+	for _, k := range m.Keys() {
+		r, ob, _ := m.Get(k)
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if strings.Contains(k, "one") || bytes.Contains(data, []byte("bit longer")) || len(ob.Meta) != 1 {
+			t.Fatalf("unencrypted object : %s %q %v", k, data, ob.Meta)
+		}
+	}
+	// the salt is not synchronized
+	m.Put(cryptSaltKey, bytes.NewReader(make([]byte, cryptSaltSize)), nil)
+	if r := src.run(t); r.Uploads != 0 || r.Identical != 4 || r.Deletions != 0 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(cs).SetHashMode(HashSHA256).SetMode(ModeRestore)
+	dst.run(t)
+	if files, want := dst.listFiles(), src.listFiles(); !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files : %v, expected %v", files, want)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst.prefix, "big")); !bytes.Equal(got, big) {
+		t.Fatal("unexpected content")
+	}
+
+	// sizes are known without reading the contents
+	for _, n := range []int{0, 1, cryptSegment - 1, cryptSegment, cryptSegment + 1} {
+		cs.Put("/size", bytes.NewReader(big[:n]), nil)
+		if ob, err := cs.Head("/size"); err != nil || ob.Size != int64(n) {
+			t.Fatalf("unexpected size for %d : %v, %v", n, ob, err)
+		}
+	}
+
+	// modified, truncated or swapped contents are detected
+	key := cs.encryptKey("/big")
+	r, ob, _ := m.Get(key)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	r, _, _ = m.Get(cs.encryptKey("/a/one"))
+	other, _ := io.ReadAll(r)
+	r.Close()
+	for _, bad := range [][]byte{
+		append(append([]byte{}, data[:100]...), append([]byte{data[100] ^ 1}, data[101:]...)...),
+		data[:cryptHeader+cryptSegment+cryptTag],
+		other,
+	} {
+		m.Put(key, bytes.NewReader(bad), ob.Meta)
+		r, _, err := cs.Get("/big")
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err == nil {
+			t.Fatal("invalid content should be detected")
+		}
+	}
+}
+
+func TestCryptNames(t *testing.T) {
+	c, m := newMemConfig(t)
+	cs, err := NewCryptStore(m, bytes.Repeat([]byte{1}, 32), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.createContent()
+	sum := sha256.Sum256([]byte("two, a bit longer"))
+	hash := hex.EncodeToString(sum[:])
+
+	// the chunks and the snapshot contents do not reveal the hashes
+	c.SetStore(NewChunkStore(cs)).SetMode(ModeBackup)
+	c.run(t)
+	c.SetMode(ModeSnapshot)
+	if _, err := c.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	names := 0
+	for _, k := range m.Keys() {
+		if strings.Contains(k, hash) {
+			t.Fatalf("the key reveals the hash : %s", k)
+		}
+		if strings.HasPrefix(k, chunksKeyPrefix) || strings.HasPrefix(k, contentKeyPrefix) {
+			names++
+		}
+	}
+	if names == 0 {
+		t.Fatalf("unexpected keys : %v", m.Keys())
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(c.store).SetMode(ModeRestore).SetSnapshot("latest")
+	dst.run(t)
+	if files, want := dst.listFiles(), c.listFiles(); !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files : %v, expected %v", files, want)
+	}
+}
+
+func TestCryptReservedNames(t *testing.T) {
+	defer func(d time.Duration) { saltDelay = d }(saltDelay)
+	saltDelay = 0
+	c, _ := newMemConfig(t)
+	ds := NewDirStore(t.TempDir())
+	key, err := PassphraseKey(ds, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := os.ReadFile(filepath.Join(ds.root, cryptSaltKey))
+	cs, err := NewCryptStore(ds, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.writeFile("a/one", "one")
+	c.writeFile(cryptSaltKey, "not the salt")
+	c.writeFile("chunks/x", "not a chunk")
+	c.writeFile("trash/x", "not trashed")
+
+	// the files named as the salt, the chunks or the trash are refused
+	c.SetStore(cs).SetMode(ModeBackup)
+	if r, err := c.Sync(); err == nil || r.Uploads != 1 || len(r.Failed) != 3 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(ds.root, cryptSaltKey)); !bytes.Equal(got, salt) {
+		t.Fatal("the salt was overwritten")
+	}
+	if k, err := PassphraseKey(ds, "passphrase"); err != nil || !bytes.Equal(k, key) {
+		t.Fatalf("unexpected key : %v", err)
+	}
+}
+
+// raceStore stores another salt once the salt is put, as a concurrent first run would.
+type raceStore struct {
+	*MemStore
+}
+
+func (s raceStore) Put(key string, r io.Reader, meta map[string]string) error {
+	if err := s.MemStore.Put(key, r, meta); err != nil || key != cryptSaltKey {
+		return err
+	}
+	return s.MemStore.Put(key, bytes.NewReader(bytes.Repeat([]byte{1}, cryptSaltSize)), nil)
+}
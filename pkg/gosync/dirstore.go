@@ -0,0 +1,236 @@
+package gosync
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DirStore is a Store backed by a local directory,
+// such as a mounted NAS or an USB disk.
+// Keys are slash separated paths, relative to the root directory.
+// A leading slash in a key is ignored for the paths, but List returns the keys as put,
+// or without it for the files put by other means.
+// The ETag and metadata of each file are kept in a sidecar JSON file,
+// in the dirMetaDir directory of the root.
+type DirStore struct {
+	root string
+	// permission mode used for creating intermediate directories.
+	dirPerm os.FileMode
+}
+
+// dirMetaDir is the directory holding the sidecar files, under the root.
+const dirMetaDir = ".gosync-meta"
+
+// dirMeta is the content of a sidecar file.
+type dirMeta struct {
+	// Key is the key as put, with its leading slash, if any.
+	Key  string            `json:"key,omitempty"`
+	ETag string            `json:"etag"`
+	Meta map[string]string `json:"meta"`
+}
+
+// NewDirStore creates a Store using root as the destination directory.
+// The directory is created as needed upon Put.
+func NewDirStore(root string) *DirStore {
+	return &DirStore{root: root, dirPerm: 0o_0777}
+}
+
+// setPerm sets the permission used for creating directories.
+func (d *DirStore) setPerm(dirPermission os.FileMode) *DirStore {
+	d.dirPerm = dirPermission
+	return d
+}
+
+func (d *DirStore) String() string {
+	return "file://" + filepath.ToSlash(d.root)
+}
+
+// path converts a key into the corresponding file path.
+func (d *DirStore) path(key string) (string, error) {
+	key = strings.TrimLeft(key, "/")
+	for i, e := range strings.Split(key, "/") {
+		if e == ".." || (i == 0 && e == dirMetaDir) {
+			return "", errors.New("invalid key, outside of root directory : " + key)
+		}
+	}
+	return filepath.Join(d.root, filepath.FromSlash(key)), nil
+}
+
+// metaPath returns the sidecar file path of a key.
+func (d *DirStore) metaPath(key string) string {
+	key = strings.TrimLeft(key, "/")
+	return filepath.Join(d.root, dirMetaDir, filepath.FromSlash(key)) + ".json"
+}
+
+// readMeta reads the sidecar file. Missing sidecar files are empty.
+func (d *DirStore) readMeta(key string) (dirMeta, error) {
+	var m dirMeta
+	data, err := os.ReadFile(d.metaPath(key))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// List walks the directory containing prefix, in lexical order.
+// A missing directory is an empty store.
+func (d *DirStore) List(prefix string, fn func(DstObject) error) error {
+	prefix = strings.TrimLeft(prefix, "/")
+	dir, err := d.path(path.Dir("/" + prefix))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p == filepath.Join(d.root, dirMetaDir) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tmpPrefix) {
+			// ignore temporary files being written
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		m, err := d.readMeta(key)
+		if err != nil {
+			return err
+		}
+		if strings.TrimLeft(m.Key, "/") == key {
+			key = m.Key
+		}
+		return fn(DstObject{
+			Key:     key,
+			Updated: info.ModTime().UTC(),
+			Size:    info.Size(),
+			ETag:    m.ETag,
+		})
+	})
+}
+
+// Head uses the file size and modification time.
+func (d *DirStore) Head(key string) (DstObject, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return DstObject{}, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return DstObject{}, ErrNotFound
+	}
+	if err != nil {
+		return DstObject{}, err
+	}
+	m, err := d.readMeta(key)
+	if err != nil {
+		return DstObject{}, err
+	}
+	return DstObject{
+		Key:     key,
+		Updated: info.ModTime().UTC(),
+		Size:    info.Size(),
+		ETag:    m.ETag,
+		Meta:    copyMeta(m.Meta),
+	}, nil
+}
+
+// Get opens the file.
+func (d *DirStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	ob, err := d.Head(key)
+	if err != nil {
+		return nil, DstObject{}, err
+	}
+	p, err := d.path(key)
+	if err != nil {
+		return nil, DstObject{}, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, DstObject{}, ErrNotFound
+	}
+	return f, ob, err
+}
+
+// Put writes a temporary file, renamed when complete,
+// so that a failed copy never leaves a truncated file behind.
+// The ETag is the MD5 of the content, as for a single part S3 upload.
+func (d *DirStore) Put(key string, r io.Reader, meta map[string]string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), d.dirPerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := createTemp(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = d.writeMeta(key, dirMeta{Key: key, ETag: hex.EncodeToString(h.Sum(nil)), Meta: meta})
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeMeta writes the sidecar file.
+func (d *DirStore) writeMeta(key string, m dirMeta) error {
+	mp := d.metaPath(key)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(mp), d.dirPerm); err != nil {
+		return err
+	}
+	return os.WriteFile(mp, data, 0o_0666)
+}
+
+// Delete removes the file, and its sidecar. Empty directories are left in place.
+func (d *DirStore) Delete(key string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(d.metaPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package gosync
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Op names the operation that failed.
+type Op string
+
+// Operations reported in errors.
+const (
+	OpWalk         Op = "walk"
+	OpList         Op = "list"
+	OpHead         Op = "head"
+	OpStat         Op = "stat"
+	OpHash         Op = "hash"
+	OpUpload       Op = "upload"
+	OpDownload     Op = "download"
+	OpDeleteFile   Op = "delete file"
+	OpDeleteObject Op = "delete object"
+	OpRemoveDir    Op = "remove dir"
+	OpState        Op = "state"
+	OpConflict     Op = "conflict"
+	OpSnapshot     Op = "snapshot"
+)
+
+// OpError records an operation that failed on a single file or object.
+type OpError struct {
+	// Op is the failed operation.
+	Op Op
+	// Key is the object key, or the file path when there is no key.
+	Key string
+	// Err is the underlying cause.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s %s : %v", e.Op, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON renders the cause as a string.
+func (e *OpError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Op    Op     `json:"op"`
+		Key   string `json:"key"`
+		Error string `json:"error"`
+	}{e.Op, e.Key, e.Err.Error()})
+}
+
+// SyncError aggregates all the failures of a run.
+// Processing continues past these failures,
+// so everything else was processed normally.
+type SyncError struct {
+	Errors []*OpError
+}
+
+func (e *SyncError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d operation(s) failed :", len(e.Errors))
+	for _, oe := range e.Errors {
+		b.WriteString("\n\t")
+		b.WriteString(oe.Error())
+	}
+	return b.String()
+}
+
+// errorList collects the failures from concurrent workers.
+type errorList struct {
+	lock sync.Mutex
+	errs []*OpError
+}
+
+// add records a failure.
+func (l *errorList) add(op Op, key string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.errs = append(l.errs, &OpError{Op: op, Key: key, Err: err})
+}
+
+// list returns a copy of the failures.
+func (l *errorList) list() []*OpError {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*OpError{}, l.errs...)
+}
+
+// err returns a *SyncError, or nil if nothing failed.
+func (l *errorList) err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return &SyncError{Errors: append([]*OpError(nil), l.errs...)}
+}
@@ -0,0 +1,226 @@
+package gosync
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultIgnoreFile is the name of the per directory ignore files.
+const DefaultIgnoreFile = ".s3syncignore"
+
+// pattern is a single gitignore-style pattern.
+type pattern struct {
+	// pattern starting with ! re-includes what was excluded before.
+	negate bool
+	// pattern ending with / only matches directories.
+	dirOnly bool
+	// pattern containing a slash is matched against the path,
+	// relative to the directory it was defined in.
+	// Otherwise, it is matched against the last path element, at any depth.
+	anchored bool
+	// slash separated glob elements, ** matches any number of elements.
+	elems []string
+	// slash separated directory the pattern was defined in, relative to the prefix.
+	base string
+}
+
+// parsePattern parses a gitignore-style pattern, defined in base.
+// It returns nil for comments and blank lines.
+func parsePattern(line string, base string) (*pattern, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	p := &pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	p.anchored = strings.Contains(line, "/")
+	line = strings.TrimLeft(line, "/")
+	if line == "" {
+		return nil, nil
+	}
+	p.elems = strings.Split(line, "/")
+	for _, e := range p.elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// match checks the slash separated path rel, relative to the prefix.
+func (p *pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.elems[0], path.Base(rel))
+		return ok
+	}
+	return matchElems(p.elems, strings.Split(rel, "/"))
+}
+
+// matchElems matches path elements against glob elements, ** included.
+func matchElems(globs []string, elems []string) bool {
+	if len(globs) == 0 {
+		return len(elems) == 0
+	}
+	if globs[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(globs[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(globs[0], elems[0]); !ok {
+		return false
+	}
+	return matchElems(globs[1:], elems[1:])
+}
+
+// filter decides which files and objects are synchronized,
+// applying the same rules to the local walk and to the object listing.
+// Excluded files are never uploaded, and excluded objects never deleted.
+type filter struct {
+	// local prefix directory, where ignore files are read.
+	root string
+	// name of the per directory ignore files, none if empty.
+	ignoreFile string
+	// exclude patterns, with a lower precedence than the ignore files.
+	excludes []*pattern
+	// if not empty, only the files matching one of the include patterns are considered.
+	includes []*pattern
+
+	lock sync.Mutex
+	// patterns read from the ignore file of each directory, relative to the prefix.
+	cache map[string][]*pattern
+}
+
+// newFilter creates the filter for the current run.
+func (c *Config) newFilter() (*filter, error) {
+	f := &filter{
+		root:       c.prefix,
+		ignoreFile: c.ignoreFile,
+		cache:      make(map[string][]*pattern),
+	}
+	for _, s := range c.excludes {
+		p, err := parsePattern(s, "")
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			f.excludes = append(f.excludes, p)
+		}
+	}
+	for _, s := range c.includes {
+		p, err := parsePattern(s, "")
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			f.includes = append(f.includes, p)
+		}
+	}
+	return f, nil
+}
+
+// patterns returns the patterns read from the ignore file in dir.
+// Missing or unreadable ignore files define no pattern.
+func (f *filter) patterns(dir string) []*pattern {
+	if f.ignoreFile == "" {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if ps, ok := f.cache[dir]; ok {
+		return ps
+	}
+	var ps []*pattern
+	file, err := os.Open(filepath.Join(f.root, filepath.FromSlash(dir), f.ignoreFile))
+	if err == nil {
+		sc := bufio.NewScanner(file)
+		for sc.Scan() {
+			if p, err := parsePattern(sc.Text(), dir); err == nil && p != nil {
+				ps = append(ps, p)
+			}
+		}
+		file.Close()
+	}
+	f.cache[dir] = ps
+	return ps
+}
+
+// ignored checks rel itself, assuming its parent directories are not ignored.
+// The last matching pattern wins, deeper ignore files taking precedence.
+func (f *filter) ignored(rel string, isDir bool) bool {
+	res := false
+	for _, p := range f.excludes {
+		if p.match(rel, isDir) {
+			res = !p.negate
+		}
+	}
+	// ignore files, from the root down to the parent dir.
+	elems := strings.Split(rel, "/")
+	for i := 0; i < len(elems); i++ {
+		for _, p := range f.patterns(strings.Join(elems[:i], "/")) {
+			if p.match(rel, isDir) {
+				res = !p.negate
+			}
+		}
+	}
+	return res
+}
+
+// included checks the file rel, and its parent directories, against the include patterns,
+// so that including a directory includes the files below it.
+func (f *filter) included(rel string) bool {
+	if len(f.includes) == 0 {
+		return true
+	}
+	elems := strings.Split(rel, "/")
+	for i := 1; i <= len(elems); i++ {
+		for _, p := range f.includes {
+			if p.match(strings.Join(elems[:i], "/"), i < len(elems)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipFile checks a file, assuming its parent directories are not ignored.
+func (f *filter) skipFile(rel string) bool {
+	return f.ignored(rel, false) || !f.included(rel)
+}
+
+// skipObject checks the file an object would correspond to,
+// including all its parent directories.
+func (f *filter) skipObject(rel string) bool {
+	elems := strings.Split(rel, "/")
+	for i := 1; i < len(elems); i++ {
+		if f.ignored(strings.Join(elems[:i], "/"), true) {
+			return true
+		}
+	}
+	return f.skipFile(rel)
+}
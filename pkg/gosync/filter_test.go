@@ -0,0 +1,121 @@
+package gosync
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	data := []struct {
+		pattern string
+		base    string
+		rel     string
+		isDir   bool
+		match   bool
+	}{
+		{"*.tmp", "", "a.tmp", false, true},
+		{"*.tmp", "", "a/b/c.tmp", false, true},
+		{"*.tmp", "", "a/b/c.tmpx", false, false},
+		{"node_modules/", "", "x/node_modules", true, true},
+		{"node_modules/", "", "x/node_modules", false, false},
+		{"/build", "", "build", true, true},
+		{"/build", "", "x/build", true, false},
+		{"a/*/c", "", "a/b/c", false, true},
+		{"a/*/c", "", "a/b/b/c", false, false},
+		{"a/**/c", "", "a/c", false, true},
+		{"a/**/c", "", "a/b/b/c", false, true},
+		{"**/cache", "", "x/y/cache", true, true},
+		{"logs/**", "", "logs/2020/a.log", false, true},
+		{"*.log", "sub", "sub/x/a.log", false, true},
+		{"*.log", "sub", "other/a.log", false, false},
+		{"/a.log", "sub", "sub/a.log", false, true},
+		{"/a.log", "sub", "a.log", false, false},
+	}
+	for _, d := range data {
+		p, err := parsePattern(d.pattern, d.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.match(d.rel, d.isDir); got != d.match {
+			t.Errorf("pattern %q in %q, matching %q (dir %v) : got %v", d.pattern, d.base, d.rel, d.isDir, got)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.writeFile("keep.txt", "keep")
+	c.writeFile("x.tmp", "tmp")
+	c.writeFile("node_modules/lib.js", "lib")
+	c.writeFile("src/main.go", "main")
+	c.writeFile("src/gen/out.go", "generated")
+	c.writeFile("src/gen/keep.go", "kept")
+	c.writeFile("src/.s3syncignore", "gen/*\n!gen/keep.go\n")
+	// object of an excluded file, should never be deleted
+	m.Put("/node_modules/old.js", bytes.NewReader([]byte("old")), nil)
+
+	c.AddExclude("*.tmp", "node_modules/")
+	c.SetMode(ModeBackup)
+	r := c.run(t)
+
+	want := []string{"/keep.txt", "/node_modules/old.js", "/src/.s3syncignore", "/src/gen/keep.go", "/src/main.go"}
+	if keys := m.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+	if r.Excluded != 4 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+
+	// only go files
+	m2 := NewMemStore()
+	c2 := tConfig{NewDefaultConfig().SetStore(m2).SetLogLevel(slog.LevelError)}
+	c2.prefix = c.prefix
+	c2.AddExclude("node_modules/").AddInclude("*.go")
+	c2.SetMode(ModeBackup)
+	c2.run(t)
+	want = []string{"/src/gen/keep.go", "/src/main.go"}
+	if keys := m2.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+
+	// only the src directory
+	m3 := NewMemStore()
+	c3 := tConfig{NewDefaultConfig().SetStore(m3).SetLogLevel(slog.LevelError)}
+	c3.prefix = c.prefix
+	c3.AddInclude("src/")
+	c3.SetMode(ModeBackup)
+	c3.run(t)
+	want = []string{"/src/.s3syncignore", "/src/gen/keep.go", "/src/main.go"}
+	if keys := m3.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	data := []struct {
+		pattern string
+		rel     string
+		match   bool
+	}{
+		{"*.go", "src/main.go", true},
+		{"docs/", "docs/a/index.md", true},
+		{"docs/", "docs", false},
+		{"docs/", "src/docs.md", false},
+		{"/src", "src/main.go", true},
+		{"/src", "x/src/main.go", false},
+		{"src/gen", "src/gen/out.go", true},
+		{"src/gen", "src/main.go", false},
+	}
+	for _, d := range data {
+		c := NewDefaultConfig().AddInclude(d.pattern)
+		f, err := c.newFilter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.included(d.rel); got != d.match {
+			t.Errorf("include %q, matching %q : got %v", d.pattern, d.rel, got)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gosync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// inode identifies a file, whatever its path.
+type inode struct {
+	dev, ino uint64
+}
+
+// pendingLink is a hard link to create, once its primary file is restored.
+type pendingLink struct {
+	absPath string
+	key     string
+	// slash separated path of the primary file, relative to the prefix.
+	primary string
+}
+
+// linkQueue collects the hard links found by the workers.
+type linkQueue struct {
+	lock  sync.Mutex
+	links []pendingLink
+}
+
+func (q *linkQueue) add(l pendingLink) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.links = append(q.links, l)
+}
+
+// primaryPath converts the stored primary file path into an absolute path,
+// inside the prefix directory.
+func (c *Config) primaryPath(primary string) (string, error) {
+	p := filepath.Join(c.prefix, filepath.FromSlash(primary))
+	if !isSubDir(c.prefix, p) || p == c.prefix {
+		return "", errors.New("hard link to a file outside of the prefix directory : " + primary)
+	}
+	return p, nil
+}
+
+// sameHardlink checks that the file is linked to the primary file.
+func (c *Config) sameHardlink(absPath string, primary string) bool {
+	p, err := c.primaryPath(primary)
+	if err != nil {
+		return false
+	}
+	i1, err := os.Stat(absPath)
+	if err != nil {
+		return false
+	}
+	i2, err := os.Stat(p)
+	return err == nil && os.SameFile(i1, i2)
+}
+
+// relink creates the hard links queued upon download.
+// It is called once the workers are done, so that the primary files are restored.
+func (c *Config) relink() {
+	for _, l := range c.relinks.links {
+		if err := c.linkFile(l.absPath, l.primary); err != nil {
+			c.fail(OpDownload, l.key, err)
+		}
+	}
+}
+
+// linkFile replaces absPath with a hard link to the primary file.
+func (c *Config) linkFile(absPath string, primary string) error {
+	p, err := c.primaryPath(primary)
+	if err != nil {
+		return err
+	}
+	tmp, err := createTemp(filepath.Dir(absPath))
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err = os.Remove(tmp.Name()); err != nil {
+		return err
+	}
+	if err = os.Link(p, tmp.Name()); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), absPath); err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
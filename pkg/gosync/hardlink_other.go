@@ -0,0 +1,10 @@
+//go:build !unix
+
+package gosync
+
+import "os"
+
+// fileID does not detect hard links on this platform.
+func fileID(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package gosync
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode of a file having several hard links.
+func fileID(info os.FileInfo) (inode, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return inode{}, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
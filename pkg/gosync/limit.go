@@ -0,0 +1,79 @@
+package gosync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DeletionLimit is the maximum number, or percentage, of deletions planned by a run,
+// such as 100 or 10%. The zero value has no limit.
+// A run planning more deletions aborts before any action, see plan.
+type DeletionLimit struct {
+	// Count is the maximum number of deletions, if positive.
+	Count int64
+	// Percent is the maximum percentage of the files and objects deleted, if positive.
+	Percent float64
+}
+
+func (l *DeletionLimit) String() string {
+	switch {
+	case l.Count > 0:
+		return strconv.FormatInt(l.Count, 10)
+	case l.Percent > 0:
+		return strconv.FormatFloat(l.Percent, 'f', -1, 64) + "%"
+	default:
+		return ""
+	}
+}
+
+// Set parses a number, or a percentage, so that it can be used as a flag.
+func (l *DeletionLimit) Set(s string) error {
+	var err error
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		*l = DeletionLimit{}
+		l.Percent, err = strconv.ParseFloat(p, 64)
+		if err == nil && (l.Percent <= 0 || l.Percent > 100) {
+			err = fmt.Errorf("out of range")
+		}
+	} else {
+		*l = DeletionLimit{}
+		l.Count, err = strconv.ParseInt(s, 10, 64)
+		if err == nil && l.Count <= 0 {
+			err = fmt.Errorf("out of range")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid deletion limit %q, use a positive number or a percentage such as 10%% : %v", s, err)
+	}
+	return nil
+}
+
+// exceeded checks the deletions planned among total files and objects.
+func (l DeletionLimit) exceeded(deletions, total int) bool {
+	if l.Count > 0 && int64(deletions) > l.Count {
+		return true
+	}
+	return l.Percent > 0 && total > 0 && float64(deletions)*100 > l.Percent*float64(total)
+}
+
+// checkDeletions aborts the plan when the deletions exceed the limit,
+// reporting each deletion that would have been performed as failed.
+func (c *Config) checkDeletions(actions []action, total int) bool {
+	var deletions []*action
+	for i := range actions {
+		if actions[i].isDelete() {
+			deletions = append(deletions, &actions[i])
+		}
+	}
+	if !c.maxDeletions.exceeded(len(deletions), total) {
+		return true
+	}
+	err := fmt.Errorf("too many deletions planned, %d of %d files and objects, above the limit of %s",
+		len(deletions), total, c.maxDeletions.String())
+	c.log.Warn("run aborted", "error", err)
+	for _, a := range deletions {
+		c.fail(a.op, a.key, err)
+	}
+	return false
+}
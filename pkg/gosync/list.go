@@ -0,0 +1,61 @@
+package gosync
+
+import (
+	"strings"
+)
+
+// walkObjects lists the store objects, within the key prefix,
+// and sends them through the objects channel, see plan.
+// Objects corresponding to excluded files, and foreign objects, are skipped, see filter and isForeignKey.
+// A listing failure stops the walk, and is returned.
+// It closes the object channel when finished.
+func (c *Config) walkObjects() error {
+
+	defer close(c.objects)
+
+	err := c.store.List(c.keyPrefix, func(o DstObject) error {
+		count(&c.report.ObjectsListed, 1)
+		if c.isForeignKey(o.Key) {
+			return nil
+		}
+		if c.filter.skipObject(strings.TrimPrefix(o.Key[len(c.keyPrefix):], "/")) {
+			count(&c.report.Excluded, 1)
+			c.log.Debug("excluded", "key", o.Key)
+			return nil
+		}
+		c.objects <- o
+		return nil
+	})
+
+	c.trace("finished walking objects")
+	return err
+
+}
+
+// isForeignKey is true for the objects that are not files :
+// the snapshots and their contents, under the key prefix,
+// and the trashed objects, the chunks and the salt of the encryption keys,
+// at the root of the bucket, when the whole bucket is synchronized.
+// Without a key prefix, the keys of the files start with a slash, see getKey.
+func (c *Config) isForeignKey(key string) bool {
+	for _, p := range []string{snapshotsKeyPrefix, contentKeyPrefix} {
+		if strings.HasPrefix(key, c.keyPrefix+p) {
+			return true
+		}
+	}
+	if c.keyPrefix != "" || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, p := range []string{trashKeyPrefix, chunksKeyPrefix, cryptSaltKey} {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedKey is true for the keys of the files that would overwrite the objects that are not files,
+// see isForeignKey. The leading slash of the keys is ignored, as stores such as DirStore ignore it.
+func (c *Config) isReservedKey(key string) bool {
+	return c.isForeignKey(key) || c.isForeignKey(strings.TrimPrefix(key, "/"))
+}
@@ -0,0 +1,60 @@
+package gosync
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// LevelTrace is the most verbose level, below slog.LevelDebug.
+// It is used for the walkers and workers start/stop chatter.
+const LevelTrace = slog.LevelDebug - 4
+
+// Logging levels, as set from the command line :
+//   - quiet   : slog.LevelWarn, only failures
+//   - default : slog.LevelInfo, every upload, download or deletion
+//   - verbose : slog.LevelDebug, also the files found identical
+//   - debug   : LevelTrace, everything
+
+// newLogger creates the default text logger, filtering on level.
+func newLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == LevelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}))
+}
+
+// SetLogger sets the logger, replacing the default one writing on stderr.
+// Messages use the key/value fields op, key, size and worker.
+func (c *Config) SetLogger(l *slog.Logger) *Config {
+	c.log = l
+	return c
+}
+
+// SetLogLevel sets the level of the default logger.
+// It has no effect on a logger set with SetLogger.
+func (c *Config) SetLogLevel(level slog.Level) *Config {
+	c.level.Set(level)
+	return c
+}
+
+// trace logs at LevelTrace.
+func (c *Config) trace(msg string, args ...interface{}) {
+	c.log.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// logAction logs an action, performed or simulated.
+func (c *Config) logAction(worker int, op Op, key string, size int64) {
+	c.log.Info(string(op), "op", op, "key", key, "size", size, "mock", c.mode.isMock(), "worker", worker)
+}
+
+// fail records a failure for the current run, and logs it.
+func (c *Config) fail(op Op, key string, err error) {
+	c.errs.add(op, key, err)
+	c.log.Warn("failed", "op", op, "key", key, "error", err)
+}
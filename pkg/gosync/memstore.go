@@ -0,0 +1,260 @@
+package gosync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore is an in-memory Store, safe for concurrent use.
+// It behaves like a bucket, and is mostly useful for offline testing.
+// It keeps the previous versions of the objects, once versioning is enabled,
+// see SetVersioning and VersionedStore.
+type MemStore struct {
+	lock    sync.RWMutex
+	objects map[string]memObject
+	// versions of the objects, by key, oldest first, when versioned.
+	versioned bool
+	history   map[string][]memVersion
+	lastID    int
+}
+
+// memObject is the content of a MemStore object.
+type memObject struct {
+	data    []byte
+	updated time.Time
+	etag    string
+	meta    map[string]string
+}
+
+// memVersion is a version of a MemStore object, or a delete marker.
+type memVersion struct {
+	memObject
+	id      string
+	deleted bool
+}
+
+// NewMemStore creates an empty in-memory Store.
+func NewMemStore() *MemStore {
+	return &MemStore{objects: make(map[string]memObject), history: make(map[string][]memVersion)}
+}
+
+// SetVersioning enables, or suspends, versioning.
+// Existing objects are not versioned.
+func (m *MemStore) SetVersioning(versioned bool) *MemStore {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.versioned = versioned
+	return m
+}
+
+// addVersion records a new version of the object, if versioned.
+// Caller must hold the lock.
+func (m *MemStore) addVersion(key string, o memObject, deleted bool) {
+	if !m.versioned {
+		return
+	}
+	m.lastID++
+	m.history[key] = append(m.history[key], memVersion{memObject: o, id: strconv.Itoa(m.lastID), deleted: deleted})
+}
+
+func (m *MemStore) String() string {
+	return "mem://"
+}
+
+// List lists objects in key order.
+func (m *MemStore) List(prefix string, fn func(DstObject) error) error {
+	for _, k := range m.Keys() {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		o, err := m.Head(k)
+		if err == ErrNotFound {
+			// deleted since we got the keys
+			continue
+		}
+		// as S3, no metadata in listings
+		o.Meta = nil
+		if err = fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Head describes the object.
+func (m *MemStore) Head(key string) (DstObject, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return DstObject{}, ErrNotFound
+	}
+	return DstObject{Key: key, Updated: o.updated, Size: int64(len(o.data)), ETag: o.etag, Meta: copyMeta(o.meta)}, nil
+}
+
+// Get returns the object content.
+func (m *MemStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, DstObject{}, ErrNotFound
+	}
+	d := DstObject{Key: key, Updated: o.updated, Size: int64(len(o.data)), ETag: o.etag, Meta: copyMeta(o.meta)}
+	return io.NopCloser(bytes.NewReader(o.data)), d, nil
+}
+
+// Put stores the full content read from r, LastModified is set to now.
+// The ETag is the MD5 of the content, as for a single part S3 upload.
+func (m *MemStore) Put(key string, r io.Reader, meta map[string]string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	o := memObject{
+		data:    data,
+		updated: time.Now().UTC(),
+		etag:    hex.EncodeToString(sum[:]),
+		meta:    copyMeta(meta),
+	}
+	m.objects[key] = o
+	m.addVersion(key, o, false)
+	return nil
+}
+
+// Copy copies the object, as a new object updated now, with the same content and metadata.
+func (m *MemStore) Copy(src, dst string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	o, ok := m.objects[src]
+	if !ok {
+		return ErrNotFound
+	}
+	o.updated = time.Now().UTC()
+	m.objects[dst] = o
+	m.addVersion(dst, o, false)
+	return nil
+}
+
+// Delete removes the object, if it exists.
+func (m *MemStore) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.objects[key]; ok {
+		m.addVersion(key, memObject{updated: time.Now().UTC()}, true)
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+// ListVersions lists the versions in key order, oldest first.
+// Objects never versioned are listed as "null" versions, as by S3.
+func (m *MemStore) ListVersions(prefix string, fn func(ObjectVersion) error) error {
+	var versions []ObjectVersion
+	m.lock.RLock()
+	keys := make([]string, 0, len(m.objects)+len(m.history))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	for k := range m.history {
+		if _, ok := m.objects[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		h := m.history[k]
+		if len(h) == 0 {
+			// as S3, no metadata in listings
+			o := m.objects[k]
+			versions = append(versions, ObjectVersion{
+				DstObject: DstObject{Key: k, Updated: o.updated, Size: int64(len(o.data)), ETag: o.etag},
+				VersionID: "null", Latest: true})
+			continue
+		}
+		for i, v := range h {
+			versions = append(versions, ObjectVersion{
+				DstObject: DstObject{Key: k, Updated: v.updated, Size: int64(len(v.data)), ETag: v.etag},
+				VersionID: v.id, Latest: i == len(h)-1, DeleteMarker: v.deleted})
+		}
+	}
+	m.lock.RUnlock()
+	for _, v := range versions {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// version returns a version of the object, the latest if versionID is empty or "null".
+func (m *MemStore) version(key, versionID string) (memObject, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if versionID == "" || versionID == "null" {
+		o, ok := m.objects[key]
+		if !ok {
+			return o, ErrNotFound
+		}
+		return o, nil
+	}
+	for _, v := range m.history[key] {
+		if v.id == versionID && !v.deleted {
+			return v.memObject, nil
+		}
+	}
+	return memObject{}, ErrNotFound
+}
+
+// HeadVersion describes a version of the object.
+func (m *MemStore) HeadVersion(key, versionID string) (DstObject, error) {
+	o, err := m.version(key, versionID)
+	if err != nil {
+		return DstObject{}, err
+	}
+	return DstObject{Key: key, Updated: o.updated, Size: int64(len(o.data)), ETag: o.etag, Meta: copyMeta(o.meta)}, nil
+}
+
+// GetVersion returns a version of the object content.
+func (m *MemStore) GetVersion(key, versionID string) (io.ReadCloser, DstObject, error) {
+	o, err := m.version(key, versionID)
+	if err != nil {
+		return nil, DstObject{}, err
+	}
+	d := DstObject{Key: key, Updated: o.updated, Size: int64(len(o.data)), ETag: o.etag, Meta: copyMeta(o.meta)}
+	return io.NopCloser(bytes.NewReader(o.data)), d, nil
+}
+
+// Keys returns the sorted list of all keys.
+func (m *MemStore) Keys() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := make([]string, 0, len(m.objects))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyMeta copies metadata, never returning nil.
+func copyMeta(meta map[string]string) map[string]string {
+	res := make(map[string]string, len(meta))
+	for k, v := range meta {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,175 @@
+package gosync
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Metadata stored with the objects, with lower case keys.
+// S3 exposes them as x-amz-meta-* headers.
+const (
+	// metaSHA256 is the hex SHA-256 of the object content.
+	metaSHA256 = "sha256"
+	// metaMtime is the source file modification time, RFC 3339 with nanoseconds, UTC.
+	metaMtime = "mtime"
+	// metaMode is the source file permission bits, including setuid, setgid and sticky, in octal.
+	metaMode = "mode"
+	// metaUID and metaGID are the numeric owner and group of the source file.
+	metaUID = "uid"
+	metaGID = "gid"
+	// metaXattrs are the extended attributes of the source file,
+	// as the base64 encoding of a JSON object.
+	metaXattrs = "xattrs"
+	// metaSymlink is the target of a stored symbolic link, see SymlinkStore.
+	metaSymlink = "symlink"
+	// metaHardlink is the slash separated path, relative to the prefix,
+	// of the file a hard link object is linked to.
+	metaHardlink = "hardlink"
+)
+
+// maxXattrsLen limits the size of the encoded extended attributes,
+// as S3 limits the whole user metadata to 2KB.
+const maxXattrsLen = 1024
+
+// uploadMeta computes the metadata stored with the object of a file.
+func (c *Config) uploadMeta(absPath string, info os.FileInfo) (map[string]string, error) {
+	meta := make(map[string]string)
+	meta[metaMtime] = info.ModTime().UTC().Format(time.RFC3339Nano)
+	if c.hashMode == HashSHA256 {
+		sum, err := fileSHA256(absPath)
+		if err != nil {
+			return nil, err
+		}
+		meta[metaSHA256] = sum
+	}
+	if c.keepAttrs {
+		attrs, err := fileAttrs(absPath, info)
+		if err != nil {
+			return nil, err
+		}
+		if len(attrs[metaXattrs]) > maxXattrsLen {
+			c.log.Warn("extended attributes too large, not saved", "path", absPath, "size", len(attrs[metaXattrs]))
+			delete(attrs, metaXattrs)
+		}
+		for k, v := range attrs {
+			meta[k] = v
+		}
+	}
+	return meta, nil
+}
+
+// fileAttrs returns the mode, ownership and extended attributes of a file, as metadata.
+// Ownership and extended attributes are only available on linux.
+func fileAttrs(absPath string, info os.FileInfo) (map[string]string, error) {
+	attrs := ownerAttrs(info)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs[metaMode] = formatMode(info.Mode())
+	x, err := xattrs(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if x != "" {
+		attrs[metaXattrs] = x
+	}
+	return attrs, nil
+}
+
+// formatMode formats the permission bits the way chmod expects them.
+func formatMode(m os.FileMode) string {
+	bits := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		bits |= 0o_4000
+	}
+	if m&os.ModeSetgid != 0 {
+		bits |= 0o_2000
+	}
+	if m&os.ModeSticky != 0 {
+		bits |= 0o_1000
+	}
+	return "0" + strconv.FormatUint(uint64(bits), 8)
+}
+
+// parseMode is the reverse of formatMode.
+func parseMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	m := os.FileMode(bits).Perm()
+	if bits&0o_4000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if bits&0o_2000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if bits&0o_1000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m, nil
+}
+
+// sameAttrs checks that the file attributes match those stored in the object metadata.
+// Attributes that were not stored are not compared, nor the owner unless owner is set.
+func sameAttrs(absPath string, ob DstObject, owner bool) (bool, error) {
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return false, err
+	}
+	attrs, err := fileAttrs(absPath, info)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range []string{metaMode, metaUID, metaGID, metaXattrs} {
+		if (k == metaUID || k == metaGID) && !owner {
+			continue
+		}
+		if v, ok := ob.Meta[k]; ok && v != attrs[k] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// storedMtime returns the source modification time stored in the object metadata.
+func storedMtime(ob DstObject) (time.Time, bool) {
+	s, ok := ob.Meta[metaMtime]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// applyMeta applies the object metadata to a downloaded file.
+// With attributes preserved, the ownership, extended attributes and mode are applied first,
+// since changing the owner clears the setuid and setgid bits.
+// The modification time comes last.
+func (c *Config) applyMeta(absPath string, ob DstObject) error {
+	if c.keepAttrs {
+		if err := applyOwner(absPath, ob.Meta); err != nil {
+			return err
+		}
+		if err := applyXattrs(absPath, ob.Meta); err != nil {
+			return err
+		}
+		if s, ok := ob.Meta[metaMode]; ok {
+			m, err := parseMode(s)
+			if err != nil {
+				return err
+			}
+			if err = os.Chmod(absPath, m); err != nil {
+				return err
+			}
+		}
+	}
+	if mtime, ok := storedMtime(ob); ok {
+		return os.Chtimes(absPath, mtime, mtime)
+	}
+	return nil
+}
@@ -14,6 +14,23 @@ const (
 	ModeRestore
 
 	ModeCleanEmptyDirs
+
+	ModeBidirectionalMock // File <=> S3
+	ModeBidirectional
+
+	ModeUploadOnlyMock // File => S3, never deleting objects
+	ModeUploadOnly
+
+	ModeDownloadOnlyMock // S3 => File, never deleting files
+	ModeDownloadOnly
+
+	ModePurgeTrash
+
+	ModeSnapshotMock // File => S3 snapshot
+	ModeSnapshot
+
+	ModePruneMock // snapshot retention, see Prune
+	ModePrune
 )
 
 func (m *Mode) String() string {
@@ -28,7 +45,90 @@ func (m *Mode) String() string {
 		return "Restore (mock): S3 --> File"
 	case ModeCleanEmptyDirs:
 		return "Cleaning empty dirs"
+	case ModeBidirectional:
+		return "Bidirectional : File <-> S3"
+	case ModeBidirectionalMock:
+		return "Bidirectional (mock) : File <-> S3"
+	case ModeUploadOnly:
+		return "Upload only : File --> S3, without deletions"
+	case ModeUploadOnlyMock:
+		return "Upload only (mock) : File --> S3, without deletions"
+	case ModeDownloadOnly:
+		return "Download only : S3 --> File, without deletions"
+	case ModeDownloadOnlyMock:
+		return "Download only (mock) : S3 --> File, without deletions"
+	case ModePurgeTrash:
+		return "Purging the trash"
+	case ModeSnapshot:
+		return "Snapshot : File --> S3 snapshot"
+	case ModeSnapshotMock:
+		return "Snapshot (mock) : File --> S3 snapshot"
+	case ModePrune:
+		return "Pruning the snapshots"
+	case ModePruneMock:
+		return "Pruning the snapshots (mock)"
 	default:
 		panic(m)
 	}
 }
+
+// isSync is true for the modes that Sync can handle.
+func (m Mode) isSync() bool {
+	switch m {
+	case ModeBackup, ModeBackupMock, ModeRestore, ModeRestoreMock, ModeBidirectional, ModeBidirectionalMock,
+		ModeUploadOnly, ModeUploadOnlyMock, ModeDownloadOnly, ModeDownloadOnlyMock:
+		return true
+	default:
+		return false
+	}
+}
+
+// isMock is true if no modification is actually performed.
+func (m Mode) isMock() bool {
+	switch m {
+	case ModeBackupMock, ModeRestoreMock, ModeBidirectionalMock, ModeUploadOnlyMock, ModeDownloadOnlyMock, ModeSnapshotMock, ModePruneMock:
+		return true
+	default:
+		return false
+	}
+}
+
+// isBackup is true for the modes updating the store from the files.
+func (m Mode) isBackup() bool {
+	return m == ModeBackup || m == ModeBackupMock || m == ModeUploadOnly || m == ModeUploadOnlyMock
+}
+
+// isAdditive is true for the modes that never delete anything.
+func (m Mode) isAdditive() bool {
+	switch m {
+	case ModeUploadOnly, ModeUploadOnlyMock, ModeDownloadOnly, ModeDownloadOnlyMock:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRestore is true for the modes updating the files from the store.
+func (m Mode) isRestore() bool {
+	switch m {
+	case ModeRestore, ModeRestoreMock, ModeDownloadOnly, ModeDownloadOnlyMock:
+		return true
+	default:
+		return false
+	}
+}
+
+// isSnapshot is true for the snapshot backup modes, see Config.Snapshot.
+func (m Mode) isSnapshot() bool {
+	return m == ModeSnapshot || m == ModeSnapshotMock
+}
+
+// isPrune is true for the snapshot retention modes, see Config.Prune.
+func (m Mode) isPrune() bool {
+	return m == ModePrune || m == ModePruneMock
+}
+
+// isBidi is true for the modes propagating the changes in both directions.
+func (m Mode) isBidi() bool {
+	return m == ModeBidirectional || m == ModeBidirectionalMock
+}
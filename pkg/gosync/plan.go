@@ -0,0 +1,283 @@
+package gosync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Plan is a serialized sync plan, computed by Config.Plan,
+// and executed later, exactly, by Config.Apply.
+type Plan struct {
+	// Mode is "backup", "restore" or "bidirectional".
+	Mode string `json:"mode"`
+	// Prefix, KeyPrefix and Store describe the configuration the plan was computed for.
+	Prefix    string    `json:"prefix"`
+	KeyPrefix string    `json:"keyPrefix"`
+	Store     string    `json:"store"`
+	Created   time.Time `json:"created"`
+	// Compared is the number of files and objects compared, see SetMaxDeletions.
+	Compared int        `json:"compared,omitempty"`
+	Items    []PlanItem `json:"items"`
+}
+
+// PlanItem is a single planned action.
+// It describes the source of the action, as found when planning :
+// the file for uploads and file deletions, the object for downloads and object deletions.
+type PlanItem struct {
+	Op     Op        `json:"op"`
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	ETag   string    `json:"etag,omitempty"`
+	Reason string    `json:"reason"`
+	// Link and Hardlink describe an uploaded link, see SrcFile.
+	Link     string `json:"link,omitempty"`
+	Hardlink string `json:"hardlink,omitempty"`
+	// KeepBoth renames the file before downloading, see ConflictKeepBoth.
+	KeepBoth bool `json:"keepBoth,omitempty"`
+}
+
+// Plan modes.
+const (
+	planBackup        = "backup"
+	planRestore       = "restore"
+	planBidirectional = "bidirectional"
+)
+
+// errChanged is the cause of the plan items refused by Apply.
+var errChanged = errors.New("changed since planning")
+
+// Plan computes the actions a sync would perform, without performing any.
+// Planning failures are returned as a *SyncError, with the plan of what could be decided.
+// A failed listing returns no plan.
+func (c *Config) Plan() (*Plan, error) {
+
+	if !c.mode.isSync() {
+		return nil, fmt.Errorf("invalid mode for planning : %d", c.mode)
+	}
+	if err := c.startRun(); err != nil {
+		return nil, err
+	}
+	actions, ok := c.plan()
+	if !ok {
+		return nil, c.errs.err()
+	}
+	if c.mode.isBidi() {
+		// the baseline is needed until the plan is applied
+		c.state.carry()
+	}
+	if err := c.state.save(); err != nil {
+		c.fail(OpState, c.stateFile, err)
+	}
+
+	p := &Plan{
+		Mode:      planRestore,
+		Prefix:    c.prefix,
+		KeyPrefix: c.keyPrefix,
+		Store:     fmt.Sprint(c.store),
+		Created:   time.Now().UTC(),
+		Compared:  c.compared,
+		Items:     make([]PlanItem, 0, len(actions)),
+	}
+	if c.mode.isBackup() {
+		p.Mode = planBackup
+	} else if c.mode.isBidi() {
+		p.Mode = planBidirectional
+	}
+	for _, a := range actions {
+		it := PlanItem{Op: a.op, Key: a.key, Reason: a.reason, KeepBoth: a.keepBoth}
+		switch a.op {
+		case OpUpload, OpDeleteFile:
+			it.Size, it.Mtime = a.file.size, a.file.updated
+			it.Link, it.Hardlink = a.file.link, a.file.hardlink
+		default:
+			ob := *a.object
+			if ob.Size < 0 {
+				// unknown size, see DstObject
+				h, err := c.store.Head(ob.Key)
+				if err != nil {
+					c.fail(OpHead, ob.Key, err)
+					continue
+				}
+				ob = h
+			}
+			it.Size, it.Mtime, it.ETag = ob.Size, ob.Updated, ob.ETag
+		}
+		p.Items = append(p.Items, it)
+	}
+	return p, c.errs.err()
+}
+
+// Apply executes the plan, exactly, in the plan mode.
+// The source of each item is checked first, and the items whose source changed
+// since planning are refused, and reported as failed.
+// The plan should have been computed for the same prefix, key prefix and store.
+// A plan with more deletions than allowed is not applied, see SetMaxDeletions,
+// a percentage applying to the files and objects compared when planning.
+func (c *Config) Apply(p *Plan) (*Report, error) {
+
+	switch p.Mode {
+	case planBackup:
+		c.mode = ModeBackup
+	case planRestore:
+		c.mode = ModeRestore
+	case planBidirectional:
+		c.mode = ModeBidirectional
+	default:
+		return nil, fmt.Errorf("invalid plan mode %q", p.Mode)
+	}
+	start := time.Now()
+	if err := c.startRun(); err != nil {
+		return nil, err
+	}
+	// the store of the run may be a point in time view, see SetAsOf
+	if p.Prefix != c.prefix || p.KeyPrefix != c.keyPrefix || p.Store != fmt.Sprint(c.store) {
+		return nil, fmt.Errorf("the plan was computed for %s, %s%s, not for %s, %v%s",
+			p.Prefix, p.Store, p.KeyPrefix, c.prefix, c.store, c.keyPrefix)
+	}
+	unlock, err := c.lockChunks()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// only the applied items are recorded
+	c.state.carry()
+
+	c.log.Debug("apply started", "mode", c.mode.String(), "items", len(p.Items))
+	actions := make([]action, 0, len(p.Items))
+	for _, it := range p.Items {
+		a, err := c.check(it)
+		if err != nil {
+			c.fail(it.Op, it.Key, err)
+			continue
+		}
+		actions = append(actions, a)
+	}
+	total := p.Compared
+	if total == 0 {
+		// plans computed before the count was recorded
+		total = len(p.Items)
+	}
+	if c.checkDeletions(actions, total) {
+		c.execute(actions)
+	}
+	if err := c.state.save(); err != nil {
+		c.fail(OpState, c.stateFile, err)
+	}
+	c.log.Debug("apply finished")
+
+	c.report.Elapsed = time.Since(start)
+	c.report.Failed = c.errs.list()
+	return c.report, c.errs.err()
+}
+
+// check turns a plan item into an action, checking that its source did not change.
+func (c *Config) check(it PlanItem) (action, error) {
+	a := action{op: it.Op, key: it.Key, reason: it.Reason, keepBoth: it.KeepBoth}
+	if a.isDelete() && c.noDelete {
+		return a, errors.New("deletions are disabled")
+	}
+	if !strings.HasPrefix(it.Key, c.keyPrefix) || c.filter.skipObject(strings.TrimPrefix(it.Key[len(c.keyPrefix):], "/")) {
+		return a, errors.New("key not synchronized")
+	}
+	var err error
+	a.absPath, err = (&DstObject{Key: it.Key}).getAbsPath(c)
+	if err != nil {
+		return a, err
+	}
+
+	switch it.Op {
+	case OpUpload:
+		a.file, err = c.checkFile(a.absPath, it)
+	case OpDownload:
+		a.object, err = c.checkObject(it)
+	case OpDeleteFile:
+		if a.file, err = c.checkFile(a.absPath, it); err == nil {
+			_, err = c.checkObject(PlanItem{Key: it.Key, Size: -1})
+		}
+	case OpDeleteObject:
+		if a.object, err = c.checkObject(it); err == nil {
+			_, err = c.checkFile(a.absPath, PlanItem{Size: -1})
+		}
+	default:
+		err = errors.New("invalid action " + string(it.Op))
+	}
+	return a, err
+}
+
+// checkFile checks that the file is as planned, or still missing for a negative size.
+func (c *Config) checkFile(absPath string, it PlanItem) (*SrcFile, error) {
+	info, link, err := c.statFile(absPath)
+	missing := os.IsNotExist(err) || (err == nil && info.IsDir())
+	if it.Size < 0 && missing {
+		return nil, nil
+	}
+	if it.Size < 0 || missing {
+		return nil, errChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	sf := newSrcFile(absPath, info, link)
+	if it.Hardlink != "" {
+		sf.hardlink, sf.size = it.Hardlink, 0
+	}
+	if sf.size != it.Size || !sf.updated.Equal(it.Mtime) || link != it.Link ||
+		(it.Hardlink != "" && !c.sameHardlink(absPath, it.Hardlink)) {
+		return nil, errChanged
+	}
+	return &sf, nil
+}
+
+// checkObject checks that the object is as planned, or still missing for a negative size.
+func (c *Config) checkObject(it PlanItem) (*DstObject, error) {
+	ob, err := c.store.Head(it.Key)
+	missing := errors.Is(err, ErrNotFound)
+	if it.Size < 0 && missing {
+		return nil, nil
+	}
+	if it.Size < 0 || missing {
+		return nil, errChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ob.Size != it.Size || ob.ETag != it.ETag {
+		return nil, errChanged
+	}
+	return &ob, nil
+}
+
+// ReadPlan reads a plan, as written by Plan.Write.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	p := new(Plan)
+	err := json.NewDecoder(r).Decode(p)
+	return p, err
+}
+
+// Write writes the plan as JSON.
+func (p *Plan) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// String prints the plan as a human readable table.
+func (p *Plan) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Mode\t%s\n", p.Mode)
+	fmt.Fprintf(w, "Created\t%v\n", p.Created)
+	for _, it := range p.Items {
+		fmt.Fprintf(w, "%s\t%s\t%d bytes\t%s\n", it.Op, it.Key, it.Size, it.Reason)
+	}
+	fmt.Fprintf(w, "Actions\t%d\n", len(p.Items))
+	w.Flush()
+	return b.String()
+}
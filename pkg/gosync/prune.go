@@ -0,0 +1,351 @@
+package gosync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy selects the snapshots kept by Prune.
+// A snapshot is kept if any rule keeps it : Last keeps the most recent snapshots,
+// Daily, Weekly and Monthly keep the most recent snapshot of as many UTC days,
+// ISO weeks and months, among the most recent ones having snapshots.
+type RetentionPolicy struct {
+	Last, Daily, Weekly, Monthly int
+	// Grace is the age of the locks of the crashed runs, ignored, see Prune.
+	// Zero means defaultLockGrace.
+	Grace time.Duration
+}
+
+// defaultLockGrace is the default age of the locks of the crashed runs,
+// that should be longer than any snapshot or prune.
+const defaultLockGrace = 24 * time.Hour
+
+// Kinds of the run locks, stored as snapshots/<run id>.<kind>.lock, under the key prefix,
+// but the locks of the chunks, stored as chunks/<run id>.<kind>.lock, at the root of the bucket,
+// by the runs storing chunks, and by prune sweeping them, see sweepChunks.
+const (
+	lockSnapshot = "snapshot"
+	lockPrune    = "prune"
+	lockChunks   = "chunks"
+	lockSweep    = "sweep"
+	lockSuffix   = ".lock"
+)
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("last %d, daily %d, weekly %d, monthly %d", p.Last, p.Daily, p.Weekly, p.Monthly)
+}
+
+func (p RetentionPolicy) grace() time.Duration {
+	if p.Grace <= 0 {
+		return defaultLockGrace
+	}
+	return p.Grace
+}
+
+// keep selects the snapshots kept, from their ids, oldest first.
+// Snapshots with an invalid id are always kept.
+func (p RetentionPolicy) keep(ids []string) map[string]bool {
+	keep := make(map[string]bool)
+	for i := len(ids) - 1; i >= 0 && len(ids)-i <= p.Last; i-- {
+		keep[ids[i]] = true
+	}
+	rules := []struct {
+		n      int
+		period func(time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%02d", y, w) }},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, r := range rules {
+		last, left := "", r.n
+		for i := len(ids) - 1; i >= 0; i-- {
+			t, err := time.Parse(trashLayout, ids[i])
+			if err != nil {
+				keep[ids[i]] = true
+				continue
+			}
+			if period := r.period(t); left > 0 && period != last {
+				keep[ids[i]] = true
+				last = period
+				left--
+			}
+		}
+	}
+	return keep
+}
+
+// lockDir returns the store, and the key prefix, of the locks of that kind.
+// The locks of the chunks are stored under the ChunkStore, that does not list the chunks.
+func (c *Config) lockDir(kind string) (Store, string) {
+	if kind == lockChunks || kind == lockSweep {
+		return c.chunkStore().Store, chunksKeyPrefix
+	}
+	return c.store, c.keyPrefix + snapshotsKeyPrefix
+}
+
+// lock stores the lock of the current run, and returns the function releasing it.
+// The runs store their lock before looking for the others, so that,
+// of two concurrent runs, at least one sees the other.
+func (c *Config) lock(kind string) (func(), error) {
+	s, dir := c.lockDir(kind)
+	key := dir + c.runID + "." + kind + lockSuffix
+	if err := s.Put(key, bytes.NewReader(nil), nil); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := s.Delete(key); err != nil {
+			c.log.Warn("lock not released", "key", key, "err", err)
+		}
+	}, nil
+}
+
+// locks lists the keys of the locks of that kind, but those older than grace.
+func (c *Config) locks(kind string, grace time.Duration) ([]string, error) {
+	var keys []string
+	suffix := "." + kind + lockSuffix
+	before := time.Now().Add(-grace)
+	s, dir := c.lockDir(kind)
+	err := s.List(dir, func(ob DstObject) error {
+		if strings.HasSuffix(ob.Key, suffix) && ob.Updated.After(before) {
+			keys = append(keys, ob.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Prune deletes the snapshots not kept by the retention policy,
+// then the contents no remaining snapshot uses, see Snapshot,
+// and, with a ChunkStore, the chunks no object uses, in the whole bucket.
+// In ModePruneMock, nothing is deleted, and the report describes what would be.
+//
+// Contents are only deleted when no snapshot is running : each snapshot, and prune,
+// holds a lock, under the snapshots/ key prefix. Snapshots fail while a prune holds one,
+// and prune only deletes the snapshots while a snapshot holds one. Likewise, the runs storing chunks
+// hold a lock, and prune does not delete the chunks while one is held, see sweepChunks.
+// Locks older than the grace period of the policy are considered left by crashed runs, and ignored.
+//
+// Failures do not stop the processing, they are listed in the Report,
+// and returned as a *SyncError.
+func (c *Config) Prune(p RetentionPolicy) (*Report, error) {
+
+	if !c.mode.isPrune() {
+		return nil, fmt.Errorf("invalid mode for a prune : %d", c.mode)
+	}
+	if p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 {
+		return nil, errors.New("the retention policy would delete every snapshot")
+	}
+	start := time.Now()
+	c.errs = new(errorList)
+	c.report = c.newReport()
+	c.runID = start.UTC().Format(runLayout)
+	c.store = c.baseStore()
+
+	c.log.Debug("prune started", "policy", p)
+	if err := c.prune(p); err != nil {
+		c.fail(OpSnapshot, c.keyPrefix+snapshotsKeyPrefix, err)
+	}
+	c.log.Debug("prune finished")
+
+	c.report.Elapsed = time.Since(start)
+	c.report.Failed = c.errs.list()
+	return c.report, c.errs.err()
+}
+
+func (c *Config) prune(p RetentionPolicy) error {
+	if !c.mode.isMock() {
+		unlock, err := c.lock(lockPrune)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	// the running snapshots are listed before the manifests,
+	// that the snapshots write before releasing their lock.
+	running, err := c.locks(lockSnapshot, p.grace())
+	if err != nil {
+		return err
+	}
+
+	ids, err := c.Snapshots()
+	if err != nil {
+		return err
+	}
+	keep := p.keep(ids)
+	used := make(map[string]bool)
+	// the objects deleted, or that would be, whose chunks are not used
+	pruned := make(map[string]bool)
+	for _, id := range ids {
+		if !keep[id] {
+			key := c.snapshotKey(id)
+			if ob, err := c.store.Head(key); err != nil {
+				c.fail(OpHead, key, err)
+			} else {
+				pruned[key] = c.pruneObject(ob)
+			}
+			continue
+		}
+		snap, err := c.ReadSnapshot(id)
+		if err != nil {
+			return err
+		}
+		for _, e := range snap.Entries {
+			used[c.contentName(e.SHA256)] = true
+		}
+	}
+
+	if len(running) > 0 {
+		c.log.Warn("contents not deleted, a snapshot is running", "lock", running[0])
+		return nil
+	}
+	var unused []DstObject
+	prefix := c.keyPrefix + contentKeyPrefix
+	err = c.store.List(prefix, func(ob DstObject) error {
+		count(&c.report.ObjectsListed, 1)
+		if !used[strings.TrimPrefix(ob.Key, prefix)] {
+			unused = append(unused, ob)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ob := range unused {
+		pruned[ob.Key] = c.pruneObject(ob)
+	}
+	return c.sweepChunks(p.grace(), pruned)
+}
+
+// pruneObject deletes an object, unless mock, counting the bytes reclaimed.
+// It returns false if the deletion failed.
+func (c *Config) pruneObject(ob DstObject) bool {
+	if !c.mode.isMock() {
+		if err := c.store.Delete(ob.Key); err != nil {
+			c.fail(OpDeleteObject, ob.Key, err)
+			return false
+		}
+	}
+	count(&c.report.Deletions, 1)
+	// unknown sizes are not counted, see DstObject
+	count(&c.report.BytesReclaimed, max(ob.Size, 0))
+	c.logAction(0, OpDeleteObject, ob.Key, max(ob.Size, 0))
+	return true
+}
+
+// chunkStore returns the configured store, if it is a ChunkStore.
+func (c *Config) chunkStore() *ChunkStore {
+	cs, _ := c.baseStore().(*ChunkStore)
+	return cs
+}
+
+// lockChunks holds the chunks lock of a run that may store chunks, see sweepChunks,
+// and fails if a prune is deleting them. It returns the function releasing the lock.
+func (c *Config) lockChunks() (func(), error) {
+	cs := c.chunkStore()
+	if cs == nil || c.mode.isMock() || c.mode.isRestore() {
+		return func() {}, nil
+	}
+	unlock, err := c.lock(lockChunks)
+	if err != nil {
+		return nil, err
+	}
+	sweeping, err := c.locks(lockSweep, defaultLockGrace)
+	if err == nil && len(sweeping) > 0 {
+		err = errors.New("a prune is deleting the chunks, see " + sweeping[0])
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	// the chunks known by a previous run may have been deleted since
+	cs.forget()
+	return unlock, nil
+}
+
+// sweepChunks deletes the chunks that no chunk list uses, in the whole bucket,
+// but the lists of the pruned objects, unless a run storing chunks holds a lock, see lockChunks.
+// A chunk list that cannot be read stops the sweep, as it may use any chunk.
+func (c *Config) sweepChunks(grace time.Duration, pruned map[string]bool) error {
+	cs := c.chunkStore()
+	if cs == nil {
+		return nil
+	}
+	if !c.mode.isMock() {
+		unlock, err := c.lock(lockSweep)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if running, err := c.locks(lockChunks, grace); err != nil {
+		return err
+	} else if len(running) > 0 {
+		c.log.Warn("chunks not deleted, a run is storing chunks", "lock", running[0])
+		return nil
+	}
+
+	// mark, heading the objects, and reading the chunk lists, in parallel
+	var keys []string
+	err := cs.Store.List("", func(ob DstObject) error {
+		if !strings.HasPrefix(ob.Key, chunksKeyPrefix) && !pruned[ob.Key] {
+			keys = append(keys, ob.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	var lock sync.Mutex
+	var errs []error
+	ch := make(chan string, len(keys))
+	wait := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for key := range ch {
+				chunks, err := cs.readList(key)
+				lock.Lock()
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					errs = append(errs, fmt.Errorf("%s : %w", key, err))
+				}
+				for _, id := range chunks {
+					used[id] = true
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	wait.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	// sweep
+	var unused []DstObject
+	err = cs.Store.List(chunksKeyPrefix, func(ob DstObject) error {
+		count(&c.report.ObjectsListed, 1)
+		if !strings.HasSuffix(ob.Key, lockSuffix) && !used[strings.TrimPrefix(ob.Key, chunksKeyPrefix)] {
+			unused = append(unused, ob)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, ob := range unused {
+		c.pruneObject(ob)
+	}
+	cs.forget()
+	return nil
+}
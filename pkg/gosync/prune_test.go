@@ -0,0 +1,174 @@
+package gosync
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	c.SetMode(ModeSnapshot)
+	if _, err := c.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	c.writeFile("a/one", "one, updated")
+	os.Remove(filepath.Join(c.prefix, "three"))
+	if _, err := c.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	keys := m.Keys()
+
+	// the first snapshot, and the contents only it uses, are deleted
+	c.SetMode(ModePruneMock)
+	r, err := c.Prune(RetentionPolicy{Last: 1})
+	if err != nil || r.Deletions != 3 || r.BytesReclaimed <= 3 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	if !reflect.DeepEqual(m.Keys(), keys) {
+		t.Fatalf("unexpected keys : %v", m.Keys())
+	}
+	c.SetMode(ModePrune)
+	if r, err := c.Prune(RetentionPolicy{Last: 1}); err != nil || r.Deletions != 3 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	if ids, _ := c.Snapshots(); len(ids) != 1 || len(m.Keys()) != 3 {
+		t.Fatalf("unexpected keys : %v", m.Keys())
+	}
+	if _, err := c.Prune(RetentionPolicy{}); err == nil {
+		t.Fatal("an empty policy should be refused")
+	}
+
+	// contents are kept while a snapshot is running
+	m.Put("content/unused", strings.NewReader("unused"), nil)
+	m.Put("snapshots/20200101-000000.snapshot.lock", bytes.NewReader(nil), nil)
+	if r, err := c.Prune(RetentionPolicy{Last: 1}); err != nil || r.Deletions != 0 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	m.Delete("snapshots/20200101-000000.snapshot.lock")
+	if r, err := c.Prune(RetentionPolicy{Last: 1}); err != nil || r.Deletions != 1 || r.BytesReclaimed != 6 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+
+	// snapshots fail while a prune is running
+	m.Put("snapshots/20200101-000000.prune.lock", bytes.NewReader(nil), nil)
+	if _, err := c.SetMode(ModeSnapshot).Snapshot(); err == nil {
+		t.Fatal("a snapshot should fail while pruning")
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	ids := []string{"20240101-100000", "20240101-120000", "20240102-100000", "20240110-100000", "20240201-100000", "20240201-110000", "manual"}
+	for _, tc := range []struct {
+		p    RetentionPolicy
+		kept []string
+	}{
+		{RetentionPolicy{Last: 2}, []string{"20240201-110000", "manual"}},
+		{RetentionPolicy{Daily: 2}, []string{"20240110-100000", "20240201-110000", "manual"}},
+		{RetentionPolicy{Weekly: 3}, []string{"20240102-100000", "20240110-100000", "20240201-110000", "manual"}},
+		{RetentionPolicy{Last: 2, Monthly: 12}, []string{"20240110-100000", "20240201-110000", "manual"}},
+	} {
+		var kept []string
+		keep := tc.p.keep(ids)
+		for _, id := range ids {
+			if keep[id] {
+				kept = append(kept, id)
+			}
+		}
+		if !reflect.DeepEqual(kept, tc.kept) {
+			t.Errorf("%v : kept %v, expected %v", tc.p, kept, tc.kept)
+		}
+	}
+}
+
+func TestPruneChunks(t *testing.T) {
+	c, m := newMemConfig(t)
+	g := &getStore{Store: m}
+	cs := new(ChunkStore).setChunkSizes(g, 64, 256, 1024)
+	chunks := func() (n int) {
+		for _, k := range m.Keys() {
+			if strings.HasPrefix(k, chunksKeyPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+	data := make([]byte, 10000)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(data)
+	c.writeFile("other", string(data))
+	c.SetStore(cs).SetMode(ModeBackup)
+	c.run(t)
+	n := chunks()
+	rnd.Read(data)
+	c.writeFile("big", string(data))
+	c.run(t)
+	os.Remove(filepath.Join(c.prefix, "big"))
+	c.run(t)
+	unused := int64(chunks() - n)
+	if unused <= 0 {
+		t.Fatalf("unexpected chunk count : %d, %d", n, unused)
+	}
+
+	// chunks are kept while a run stores chunks
+	m.Put("chunks/20200101-000000.chunks.lock", bytes.NewReader(nil), nil)
+	c.SetMode(ModePrune)
+	if r, err := c.Prune(RetentionPolicy{Last: 1}); err != nil || r.Deletions != 0 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	m.Delete("chunks/20200101-000000.chunks.lock")
+
+	// the chunks only the deleted object used are deleted
+	c.SetMode(ModePruneMock)
+	if r, err := c.Prune(RetentionPolicy{Last: 1}); err != nil || r.Deletions != unused {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	// only the chunk lists are read
+	m.Put("/plain", strings.NewReader("plain"), nil)
+	g.keys = nil
+	c.SetMode(ModePrune)
+	if r, err := c.Prune(RetentionPolicy{Last: 1}); err != nil || r.Deletions != unused || r.BytesReclaimed != 10000 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	for _, k := range g.keys {
+		if k == "/plain" {
+			t.Fatal("the objects without chunks should not be read")
+		}
+	}
+	if chunks() != n {
+		t.Fatalf("unexpected keys : %v", m.Keys())
+	}
+	dst, _ := newMemConfig(t)
+	dst.SetStore(cs).SetMode(ModeRestore)
+	dst.run(t)
+	if got, _ := os.ReadFile(filepath.Join(dst.prefix, "other")); len(got) != 10000 {
+		t.Fatal("unexpected content")
+	}
+
+	// backups fail while a prune deletes the chunks
+	m.Put("chunks/20200101-000000.sweep.lock", bytes.NewReader(nil), nil)
+	if _, err := c.SetMode(ModeBackup).Sync(); err == nil {
+		t.Fatal("a backup should fail while deleting the chunks")
+	}
+}
+
+// getStore records the keys read.
+type getStore struct {
+	Store
+	lock sync.Mutex
+	keys []string
+}
+
+func (g *getStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	g.lock.Lock()
+	g.keys = append(g.keys, key)
+	g.lock.Unlock()
+	return g.Store.Get(key)
+}
@@ -0,0 +1,112 @@
+package gosync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Report summarizes a run.
+// In the xxxMock modes, it describes what would have been done.
+// Counters are updated atomically by the workers.
+type Report struct {
+	Mode string `json:"mode"`
+	// FilesScanned is the number of local files walked.
+	FilesScanned int64 `json:"filesScanned"`
+	// ObjectsListed is the number of objects listed in the store.
+	ObjectsListed int64 `json:"objectsListed"`
+	Uploads       int64 `json:"uploads"`
+	Downloads     int64 `json:"downloads"`
+	// Deletions counts both files and objects deleted.
+	Deletions int64 `json:"deletions"`
+	// Identical counts the files found identical to their object, and skipped.
+	Identical int64 `json:"identical"`
+	// Conflicts counts the files and objects that both changed since the last sync,
+	// in the bidirectional modes.
+	Conflicts int64 `json:"conflicts"`
+	// Kept counts the files and objects not deleted, because deletions are disabled.
+	Kept int64 `json:"kept"`
+	// Excluded counts the files, directories or objects skipped by the filters.
+	Excluded int64 `json:"excluded"`
+	// BytesTransferred counts uploaded and downloaded bytes.
+	BytesTransferred int64 `json:"bytesTransferred"`
+	// BytesReclaimed counts the bytes of the objects deleted by a prune.
+	BytesReclaimed int64 `json:"bytesReclaimed"`
+	// Elapsed time, in nanoseconds for JSON.
+	Elapsed time.Duration `json:"elapsedNs"`
+	// Failed lists the failed operations.
+	Failed []*OpError `json:"failed"`
+}
+
+// newReport starts a new report for the configured mode.
+func (c *Config) newReport() *Report {
+	return &Report{Mode: c.mode.String(), Failed: []*OpError{}}
+}
+
+// Add adds the counters and failures of other into r,
+// typically to merge the reports of several runs.
+func (r *Report) Add(other *Report) *Report {
+	if other == nil {
+		return r
+	}
+	r.FilesScanned += other.FilesScanned
+	r.ObjectsListed += other.ObjectsListed
+	r.Uploads += other.Uploads
+	r.Downloads += other.Downloads
+	r.Deletions += other.Deletions
+	r.Identical += other.Identical
+	r.Conflicts += other.Conflicts
+	r.Kept += other.Kept
+	r.Excluded += other.Excluded
+	r.BytesTransferred += other.BytesTransferred
+	r.BytesReclaimed += other.BytesReclaimed
+	r.Elapsed += other.Elapsed
+	r.Failed = append(r.Failed, other.Failed...)
+	return r
+}
+
+// count atomically increments a counter.
+func count(counter *int64, delta int64) {
+	atomic.AddInt64(counter, delta)
+}
+
+// String prints the report as a human readable table.
+func (r *Report) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Mode\t%s\n", r.Mode)
+	fmt.Fprintf(w, "Files scanned\t%d\n", r.FilesScanned)
+	fmt.Fprintf(w, "Objects listed\t%d\n", r.ObjectsListed)
+	fmt.Fprintf(w, "Uploads\t%d\n", r.Uploads)
+	fmt.Fprintf(w, "Downloads\t%d\n", r.Downloads)
+	fmt.Fprintf(w, "Deletions\t%d\n", r.Deletions)
+	fmt.Fprintf(w, "Identical\t%d\n", r.Identical)
+	fmt.Fprintf(w, "Conflicts\t%d\n", r.Conflicts)
+	fmt.Fprintf(w, "Kept\t%d\n", r.Kept)
+	fmt.Fprintf(w, "Excluded\t%d\n", r.Excluded)
+	fmt.Fprintf(w, "Bytes transferred\t%d\n", r.BytesTransferred)
+	fmt.Fprintf(w, "Bytes reclaimed\t%d\n", r.BytesReclaimed)
+	fmt.Fprintf(w, "Elapsed\t%v\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Failures\t%d\n", len(r.Failed))
+	w.Flush()
+	for _, e := range r.Failed {
+		b.WriteString("\t" + e.Error() + "\n")
+	}
+	return b.String()
+}
+
+// WriteReport writes the report to w,
+// as JSON if requested with the -json flag, or as a table.
+func (c *Config) WriteReport(w io.Writer, r *Report) error {
+	if !c.jsonReport {
+		_, err := io.WriteString(w, r.String())
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
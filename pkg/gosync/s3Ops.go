@@ -1,107 +1,189 @@
 package gosync
 
 import (
-	"fmt"
+	"errors"
+	"io"
 	"os"
 	"path"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// uploadFile upload a potentially large file to S3
-func (c *Config) uploadFile(sf SrcFile) {
+// uploadFile upload a potentially large file to the store,
+// with its metadata, see uploadMeta.
+// It returns the number of bytes uploaded.
+func (c *Config) uploadFile(sf SrcFile) (int64, error) {
+
+	key := c.getKey(sf)
+	if key == "" {
+		return 0, errors.New("file is outside of the prefix directory : " + sf.absPath)
+	}
+
+	if sf.link != "" || sf.hardlink != "" {
+		return 0, c.uploadLink(key, sf)
+	}
 
 	file, err := os.Open(sf.absPath)
 	if err != nil {
-		fmt.Println(sf.String())
-		panic(err)
+		return 0, err
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	meta, err := c.uploadMeta(sf.absPath, info)
+	if err != nil {
+		return 0, err
+	}
 
-	up := s3manager.NewUploader(c.sess)
-	_, err = up.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(c.bucket),
-		Key:    aws.String(c.getKey(sf)),
-		Body:   file,
-	})
+	// The file itself is provided, so that the uploader knows its size.
+	err = c.store.Put(key, file, meta)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
+	return info.Size(), nil
 }
 
-// deleteFile does just that ...
-func (c *Config) deleteFile(sf SrcFile) {
-	err := os.Remove(sf.absPath)
+// uploadLink stores a symbolic or hard link, as an empty object
+// with the link target, or the primary file, in its metadata.
+func (c *Config) uploadLink(key string, sf SrcFile) error {
+	meta, err := linkMeta(sf)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	return c.store.Put(key, strings.NewReader(""), meta)
+}
+
+// linkMeta returns the metadata of a symbolic or hard link, see uploadLink.
+func linkMeta(sf SrcFile) (map[string]string, error) {
+	info, err := os.Lstat(sf.absPath)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		metaMtime: info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+	if sf.link != "" {
+		meta[metaSymlink] = sf.link
+	} else {
+		meta[metaHardlink] = sf.hardlink
+	}
+	return meta, nil
+}
+
+// deleteFile does just that ...
+// or moves the file to the trash, see SetTrash.
+func (c *Config) deleteFile(sf SrcFile) error {
+	if c.trash {
+		return c.trashFile(sf.absPath)
 	}
+	return os.Remove(sf.absPath)
 }
 
-// downloadFile downloads a potentially large object from S3 to file,
+// downloadFile downloads a potentially large object from the store to file,
 // overwriting existing file.
-func (c *Config) downloadFile(sf SrcFile) {
-	var err error
-	file, err := os.Create(sf.absPath)
+// The content is first written to a temporary file in the same directory,
+// so that a failed download never leaves a truncated file behind.
+// The object metadata, such as the source modification time, are then applied.
+// Stored links are recreated as links, hard links once the workers are done, see relink.
+// It returns the number of bytes written.
+func (c *Config) downloadFile(sf SrcFile) (int64, error) {
+
+	key := c.getKey(sf)
+	if key == "" {
+		return 0, errors.New("file is outside of the prefix directory : " + sf.absPath)
+	}
+	if err := c.checkParents(sf.absPath); err != nil {
+		return 0, err
+	}
+
+	dir := path.Dir(sf.absPath)
+	file, err := createTemp(dir)
 	if err != nil {
 		// Most likely, the dir does not exist,
 		// let's try to create it and retry file creation ...
-		fmt.Println("Attempting to recover from :", err)
-		dir := path.Dir(sf.absPath)
-		fmt.Printf("\nCreating directories for %s\n", dir)
+		c.log.Debug("creating directories", "dir", dir, "cause", err)
 		err = os.MkdirAll(dir, c.dirPerm)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
-		file, err = os.Create(sf.absPath)
+		file, err = createTemp(dir)
 		if err != nil {
-			fmt.Println("After successfully creating dir, error persists : ", err)
-			panic(err)
+			return 0, err
 		}
 	}
-	defer file.Close()
-
-	down := s3manager.NewDownloader(c.sess)
-	_, err = down.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(c.bucket),
-			Key:    aws.String(c.getKey(sf)),
-		})
 
+	n, ob, err := c.copyObject(key, file)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if primary := ob.Meta[metaHardlink]; err == nil && primary != "" {
+		// a hard link, created once the primary file is restored
+		os.Remove(file.Name())
+		c.relinks.add(pendingLink{absPath: sf.absPath, key: key, primary: primary})
+		return 0, nil
+	}
+	if target := ob.Meta[metaSymlink]; err == nil && target != "" {
+		// a stored link, replace the temporary file with the link
+		if err = os.Remove(file.Name()); err == nil {
+			err = os.Symlink(target, file.Name())
+		}
+	} else if err == nil {
+		err = c.applyMeta(file.Name(), ob)
+	}
+	if err == nil {
+		// a link may have been restored meanwhile, by another worker
+		err = c.checkParents(sf.absPath)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), sf.absPath)
+	}
 	if err != nil {
-		fmt.Println(sf)
-		panic(err)
+		os.Remove(file.Name())
 	}
+	return n, err
 }
 
-// deleteObject delete the provided object from s3
-func (c *Config) deleteObject(ob DstObject) {
-
-	_, err := c.s3.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(c.bucket),
-		Key:    aws.String(ob.key),
-	})
-
-	if err != nil {
-		panic(err)
+// tmpPrefix is used for files being written.
+const tmpPrefix = ".gosync-tmp-"
+
+// tmpCounter makes temporary file names unique within the process.
+var tmpCounter uint64
+
+// createTemp creates a new temporary file in dir,
+// with the same permission as os.Create would use.
+func createTemp(dir string) (*os.File, error) {
+	for {
+		n := atomic.AddUint64(&tmpCounter, 1)
+		name := filepath.Join(dir, tmpPrefix+strconv.Itoa(os.Getpid())+"-"+strconv.FormatUint(n, 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o_0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
 	}
-
 }
 
-// uploadObject refresh the s3 object from corresponding file
-func (c *Config) uploadObject(ob DstObject) {
-	c.uploadFile(
-		SrcFile{
-			absPath: ob.getAbsPath(c),
-		})
+// copyObject writes the object content into w, and describes the object.
+func (c *Config) copyObject(key string, w io.Writer) (int64, DstObject, error) {
+	body, ob, err := c.store.Get(key)
+	if err != nil {
+		return 0, ob, err
+	}
+	defer body.Close()
+	n, err := io.Copy(w, body)
+	return n, ob, err
 }
 
-// downloadObject downloads an S3 object to the local file system.
-func (c *Config) downloadObject(ob DstObject) {
-	c.downloadFile(
-		SrcFile{
-			absPath: ob.getAbsPath(c),
-		})
-
+// deleteObject delete the provided object from the store,
+// or moves it to the trash, see SetTrash.
+func (c *Config) deleteObject(ob DstObject) error {
+	if c.trash {
+		return c.trashObject(ob.Key)
+	}
+	return c.store.Delete(ob.Key)
 }
@@ -1,7 +1,30 @@
 package gosync
 
-import "testing"
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
 
 func TestUpload(t *testing.T) {
-	_ = NewDefaultConfig()
+	c, m := newMemConfig(t)
+
+	c.writeFile("one", "hello")
+	sf := SrcFile{absPath: filepath.Join(c.prefix, "one")}
+	if _, err := c.uploadFile(sf); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _, err := m.Get("/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("unexpected content : %q", data)
+	}
 }
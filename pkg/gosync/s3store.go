@@ -0,0 +1,280 @@
+package gosync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Store is the Store adapter for an AWS S3 bucket.
+type s3Store struct {
+	bucket string
+	s3     *s3.S3
+	up     *s3manager.Uploader
+}
+
+// NewS3Store creates a Store backed by an existing S3 bucket.
+// Upload use the s3manager API, allowing for very large objects.
+// The store keeps versions if versioning is enabled on the bucket, see VersionedStore.
+func NewS3Store(sess *session.Session, bucket string) Store {
+	return &s3Store{
+		bucket: bucket,
+		s3:     s3.New(sess),
+		up:     s3manager.NewUploader(sess),
+	}
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket
+}
+
+// List uses ListObjectsV2, page by page.
+func (s *s3Store) List(prefix string, fn func(DstObject) error) error {
+	var e error
+	li := new(s3.ListObjectsV2Input).SetBucket(s.bucket)
+	if prefix != "" {
+		li.SetPrefix(prefix)
+	}
+	err := s.s3.ListObjectsV2Pages(li, func(res *s3.ListObjectsV2Output, lastpage bool) bool {
+		for _, o := range res.Contents {
+			var d DstObject
+			if d, e = dstObjectFromS3Object(o); e != nil {
+				return false
+			}
+			if e = fn(d); e != nil {
+				return false
+			}
+		}
+		return !lastpage
+	})
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+func (s *s3Store) Head(key string) (DstObject, error) {
+	return s.HeadVersion(key, "")
+}
+
+// HeadVersion describes a version of the object, the latest if versionID is empty.
+func (s *s3Store) HeadVersion(key, versionID string) (DstObject, error) {
+	in := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		in.SetVersionId(versionID)
+	}
+	out, err := s.s3.HeadObject(in)
+	if err != nil {
+		return DstObject{}, s3Error(err)
+	}
+	return DstObject{
+		Key:     key,
+		Updated: out.LastModified.UTC(),
+		Size:    *out.ContentLength,
+		ETag:    strings.Trim(aws.StringValue(out.ETag), "\""),
+		Meta:    s3Meta(out.Metadata),
+	}, nil
+}
+
+func (s *s3Store) Get(key string) (io.ReadCloser, DstObject, error) {
+	return s.GetVersion(key, "")
+}
+
+// GetVersion opens a version of the object, the latest if versionID is empty.
+func (s *s3Store) GetVersion(key, versionID string) (io.ReadCloser, DstObject, error) {
+	in := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		in.SetVersionId(versionID)
+	}
+	out, err := s.s3.GetObject(in)
+	if err != nil {
+		return nil, DstObject{}, s3Error(err)
+	}
+	return out.Body, DstObject{
+		Key:     key,
+		Updated: out.LastModified.UTC(),
+		Size:    *out.ContentLength,
+		ETag:    strings.Trim(aws.StringValue(out.ETag), "\""),
+		Meta:    s3Meta(out.Metadata),
+	}, nil
+}
+
+// ListVersions uses ListObjectVersions, page by page.
+// A bucket without versioning lists its objects as "null" versions.
+func (s *s3Store) ListVersions(prefix string, fn func(ObjectVersion) error) error {
+	var e error
+	li := new(s3.ListObjectVersionsInput).SetBucket(s.bucket)
+	if prefix != "" {
+		li.SetPrefix(prefix)
+	}
+	err := s.s3.ListObjectVersionsPages(li, func(res *s3.ListObjectVersionsOutput, lastpage bool) bool {
+		for _, o := range res.Versions {
+			v := ObjectVersion{
+				DstObject: DstObject{
+					Key:     aws.StringValue(o.Key),
+					Updated: aws.TimeValue(o.LastModified).UTC(),
+					Size:    aws.Int64Value(o.Size),
+					ETag:    strings.Trim(aws.StringValue(o.ETag), "\""),
+				},
+				VersionID: aws.StringValue(o.VersionId),
+				Latest:    aws.BoolValue(o.IsLatest),
+			}
+			if e = fn(v); e != nil {
+				return false
+			}
+		}
+		for _, o := range res.DeleteMarkers {
+			v := ObjectVersion{
+				DstObject: DstObject{
+					Key:     aws.StringValue(o.Key),
+					Updated: aws.TimeValue(o.LastModified).UTC(),
+				},
+				VersionID:    aws.StringValue(o.VersionId),
+				Latest:       aws.BoolValue(o.IsLatest),
+				DeleteMarker: true,
+			}
+			if e = fn(v); e != nil {
+				return false
+			}
+		}
+		return !lastpage
+	})
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+// s3Meta converts the user metadata, with lower case keys.
+func s3Meta(m map[string]*string) map[string]string {
+	meta := make(map[string]string, len(m))
+	for k, v := range m {
+		// the sdk canonicalizes the header names
+		meta[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return meta
+}
+
+// maxCopySize is the largest object copied in a single request, larger ones are copied in parts.
+const maxCopySize = 5 << 30
+
+// copyPartSize is the size of the parts of the copies in parts.
+const copyPartSize = 512 << 20
+
+// Copy copies the object in the bucket, with its metadata, using CopyObject,
+// or UploadPartCopy for the objects larger than 5 GiB.
+func (s *s3Store) Copy(src, dst string) error {
+	ob, err := s.Head(src)
+	if err != nil {
+		return err
+	}
+	source := url.PathEscape(s.bucket + "/" + src)
+	if ob.Size <= maxCopySize {
+		_, err = s.s3.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(dst),
+			CopySource: aws.String(source),
+		})
+		return s3Error(err)
+	}
+
+	mp, err := s.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(dst),
+		Metadata: aws.StringMap(ob.Meta),
+	})
+	if err != nil {
+		return err
+	}
+	var parts []*s3.CompletedPart
+	for start, n := int64(0), int64(1); start < ob.Size; start, n = start+copyPartSize, n+1 {
+		end := start + copyPartSize - 1
+		if end >= ob.Size {
+			end = ob.Size - 1
+		}
+		out, err := s.s3.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dst),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      aws.Int64(n),
+			UploadId:        mp.UploadId,
+		})
+		if err != nil {
+			s.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(s.bucket), Key: aws.String(dst), UploadId: mp.UploadId})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+	_, err = s.s3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(dst),
+		UploadId:        mp.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// Put stores the metadata as x-amz-meta-* headers.
+func (s *s3Store) Put(key string, r io.Reader, meta map[string]string) error {
+	in := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	}
+	if len(meta) != 0 {
+		in.Metadata = aws.StringMap(meta)
+	}
+	_, err := s.up.Upload(in)
+	return err
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// s3Error translates missing object errors into ErrNotFound.
+func s3Error(err error) error {
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && rf.StatusCode() == http.StatusNotFound {
+		return ErrNotFound
+	}
+	var ae awserr.Error
+	if errors.As(err, &ae) && ae.Code() == s3.ErrCodeNoSuchKey {
+		return ErrNotFound
+	}
+	return err
+}
+
+// dstObjectFromS3Object return a DstObject from an s3.Object,
+// or an error if the listing returned an object without a key.
+func dstObjectFromS3Object(o *s3.Object) (DstObject, error) {
+	if o == nil || o.Key == nil {
+		return DstObject{}, errors.New("cannot process a nil s3.object")
+	}
+	d := DstObject{}
+	d.Key = *o.Key
+	d.Updated = aws.TimeValue(o.LastModified).UTC()
+	d.Size = aws.Int64Value(o.Size)
+	d.ETag = strings.Trim(aws.StringValue(o.ETag), "\"")
+	return d, nil
+}
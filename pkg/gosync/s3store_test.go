@@ -0,0 +1,20 @@
+package gosync
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestDstObjectFromS3Object(t *testing.T) {
+	for _, o := range []*s3.Object{nil, {}} {
+		if _, err := dstObjectFromS3Object(o); err == nil {
+			t.Fatalf("expected an error for %v", o)
+		}
+	}
+	d, err := dstObjectFromS3Object(&s3.Object{Key: aws.String("/a"), ETag: aws.String(`"x"`)})
+	if err != nil || d.Key != "/a" || d.ETag != "x" || d.Size != 0 {
+		t.Fatalf("unexpected object : %v, %v", d, err)
+	}
+}
@@ -0,0 +1,406 @@
+package gosync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is the manifest of a snapshot backup, stored as snapshots/<id>.json,
+// under the key prefix. It is never modified once written.
+// The id is the UTC start time of the run, such as 20200102-150405.
+type Snapshot struct {
+	ID      string          `json:"id"`
+	Created time.Time       `json:"created"`
+	Prefix  string          `json:"prefix"`
+	Entries []SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry describes a file of a snapshot.
+type SnapshotEntry struct {
+	// Path is slash separated, relative to the prefix.
+	Path  string    `json:"path"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	// SHA256 references the content, stored once, see contentKey, none for links.
+	SHA256 string `json:"sha256,omitempty"`
+	// Meta is the metadata an upload would store, see uploadMeta and uploadLink.
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Key prefixes of the snapshot manifests and contents, under the key prefix.
+const (
+	snapshotsKeyPrefix = "snapshots/"
+	contentKeyPrefix   = "content/"
+)
+
+// snapshotLatest designates the most recent snapshot, see SetSnapshot.
+const snapshotLatest = "latest"
+
+func (c *Config) snapshotKey(id string) string {
+	return c.keyPrefix + snapshotsKeyPrefix + id + ".json"
+}
+
+func (c *Config) contentKey(sum string) string {
+	return c.keyPrefix + contentKeyPrefix + c.contentName(sum)
+}
+
+// contentName is the name of a content, from its hex SHA-256, as named by the store, see nameHasher.
+func (c *Config) contentName(sum string) string {
+	if h, ok := c.baseStore().(nameHasher); ok {
+		return h.hashName(sum)
+	}
+	return sum
+}
+
+// Snapshot backs up the files into a new snapshot, see Snapshot.
+// Each content is stored once, whatever the file, or the snapshot, using it.
+// Files unchanged since the previous snapshot, in size and modification time,
+// are not hashed again. Existing contents are counted as identical.
+// The run holds a lock, and fails if a prune is running, see Prune.
+// With a ChunkStore, it holds the lock of the chunks too.
+// In ModeSnapshotMock, nothing is stored.
+// Failures do not stop the processing, they are listed in the Report,
+// and returned as a *SyncError. The failed files are missing from the snapshot.
+func (c *Config) Snapshot() (*Report, error) {
+
+	if !c.mode.isSnapshot() {
+		return nil, fmt.Errorf("invalid mode for a snapshot : %d", c.mode)
+	}
+	start := time.Now()
+	if err := c.startRun(); err != nil {
+		return nil, err
+	}
+	unlock, err := c.lockChunks()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c.log.Debug("snapshot started", "id", c.runID)
+	if err := c.snapshot(); err != nil {
+		c.fail(OpSnapshot, c.snapshotKey(c.runID), err)
+	}
+	c.log.Debug("snapshot finished")
+
+	c.report.Elapsed = time.Since(start)
+	c.report.Failed = c.errs.list()
+	return c.report, c.errs.err()
+}
+
+// snapshot walks the files, uploads the missing contents, then writes the manifest.
+func (c *Config) snapshot() error {
+	key := c.snapshotKey(c.runID)
+	if _, err := c.store.Head(key); err == nil {
+		return errors.New("the snapshot already exists")
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if !c.mode.isMock() {
+		unlock, err := c.lock(lockSnapshot)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		// contents found stored could be deleted
+		if pruning, err := c.locks(lockPrune, defaultLockGrace); err != nil {
+			return err
+		} else if len(pruning) > 0 {
+			return errors.New("a prune is running, see " + pruning[0])
+		}
+	}
+	prev := make(map[string]SnapshotEntry)
+	if ids, err := c.Snapshots(); err != nil {
+		return err
+	} else if len(ids) > 0 {
+		p, err := c.ReadSnapshot(ids[len(ids)-1])
+		if err != nil {
+			return err
+		}
+		for _, e := range p.Entries {
+			prev[e.Path] = e
+		}
+	}
+	stored := make(map[string]bool)
+	err := c.store.List(c.keyPrefix+contentKeyPrefix, func(ob DstObject) error {
+		stored[strings.TrimPrefix(ob.Key, c.keyPrefix+contentKeyPrefix)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// walk, and hash in parallel
+	c.files = make(chan SrcFile, 2000)
+	wait := new(sync.WaitGroup)
+	wait.Add(1)
+	go c.walkFiles(wait)
+	var lock sync.Mutex
+	var entries []SnapshotEntry
+	var files []SrcFile
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for sf := range c.files {
+				e, err := c.snapshotEntry(sf, prev)
+				if err != nil {
+					c.fail(OpHash, sf.absPath, err)
+					continue
+				}
+				lock.Lock()
+				entries, files = append(entries, e), append(files, sf)
+				lock.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+
+	// upload each missing content once, from the first file found
+	uploads := make(map[string]int)
+	for i, e := range entries {
+		if e.SHA256 == "" {
+			continue
+		}
+		if _, ok := uploads[e.SHA256]; ok || stored[c.contentName(e.SHA256)] {
+			count(&c.report.Identical, 1)
+			continue
+		}
+		uploads[e.SHA256] = i
+	}
+	failed := make(map[string]bool)
+	ch := make(chan int, 2000)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := range ch {
+				e := entries[i]
+				n, err := e.Size, error(nil)
+				if !c.mode.isMock() {
+					n, err = c.uploadContent(files[i].absPath, e)
+				}
+				count(&c.report.BytesTransferred, n)
+				if err != nil {
+					c.fail(OpUpload, e.Path, err)
+					lock.Lock()
+					failed[e.SHA256] = true
+					lock.Unlock()
+					continue
+				}
+				count(&c.report.Uploads, 1)
+				c.logAction(worker, OpUpload, c.contentKey(e.SHA256), n)
+			}
+		}(i)
+	}
+	for _, i := range uploads {
+		ch <- i
+	}
+	close(ch)
+	wait.Wait()
+
+	snap := Snapshot{ID: c.runID, Created: time.Now().UTC(), Prefix: c.prefix}
+	for _, e := range entries {
+		if !failed[e.SHA256] {
+			snap.Entries = append(snap.Entries, e)
+		}
+	}
+	sort.Slice(snap.Entries, func(i, j int) bool { return snap.Entries[i].Path < snap.Entries[j].Path })
+	if c.mode.isMock() {
+		return nil
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	c.logAction(0, OpSnapshot, key, int64(len(data)))
+	return c.store.Put(key, bytes.NewReader(data), nil)
+}
+
+// snapshotEntry describes a walked file, hashing it unless unchanged since the previous snapshot.
+func (c *Config) snapshotEntry(sf SrcFile, prev map[string]SnapshotEntry) (SnapshotEntry, error) {
+	e := SnapshotEntry{Path: c.relPath(sf), Mtime: sf.updated}
+	var err error
+	if sf.link != "" || sf.hardlink != "" {
+		e.Meta, err = linkMeta(sf)
+		return e, err
+	}
+	info, err := os.Stat(sf.absPath)
+	if err != nil {
+		return e, err
+	}
+	e.Size, e.Mtime = info.Size(), info.ModTime().UTC()
+	if e.Meta, err = c.uploadMeta(sf.absPath, info); err != nil {
+		return e, err
+	}
+	e.SHA256 = e.Meta[metaSHA256]
+	if p, ok := prev[e.Path]; e.SHA256 == "" && ok && p.SHA256 != "" && p.Size == e.Size && p.Mtime.Equal(e.Mtime) {
+		e.SHA256 = p.SHA256
+	}
+	if e.SHA256 == "" {
+		if e.SHA256, err = fileSHA256(sf.absPath); err != nil {
+			return e, err
+		}
+	}
+	e.Meta[metaSHA256] = e.SHA256
+	return e, nil
+}
+
+// uploadContent uploads the content of a file, checking it did not change since hashed.
+// It returns the number of bytes uploaded.
+func (c *Config) uploadContent(absPath string, e SnapshotEntry) (int64, error) {
+	file, err := os.Open(absPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	key := c.contentKey(e.SHA256)
+	if err = c.store.Put(key, file, nil); err != nil {
+		return 0, err
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != e.Size || !info.ModTime().UTC().Equal(e.Mtime) {
+		c.store.Delete(key)
+		return 0, errors.New("file changed while uploaded")
+	}
+	return e.Size, nil
+}
+
+// Snapshots lists the snapshot ids, oldest first.
+func (c *Config) Snapshots() ([]string, error) {
+	var ids []string
+	prefix := c.keyPrefix + snapshotsKeyPrefix
+	err := c.baseStore().List(prefix, func(ob DstObject) error {
+		if id := strings.TrimPrefix(ob.Key, prefix); strings.HasSuffix(id, ".json") && !strings.Contains(id, "/") {
+			ids = append(ids, strings.TrimSuffix(id, ".json"))
+		}
+		return nil
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+// ReadSnapshot reads the manifest of a snapshot, or of the latest one.
+func (c *Config) ReadSnapshot(id string) (*Snapshot, error) {
+	if id == snapshotLatest {
+		ids, err := c.Snapshots()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, errors.New("no snapshot found")
+		}
+		id = ids[len(ids)-1]
+	}
+	r, _, err := c.baseStore().Get(c.snapshotKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s : %w", id, err)
+	}
+	defer r.Close()
+	snap := new(Snapshot)
+	err = json.NewDecoder(r).Decode(snap)
+	return snap, err
+}
+
+// snapshotStore is a read only view of the files of a snapshot,
+// as objects whose content is read from the content objects.
+type snapshotStore struct {
+	Store
+	c  *Config
+	id string
+	// entries by key
+	entries map[string]SnapshotEntry
+}
+
+func (s *snapshotStore) base() Store {
+	return s.Store
+}
+
+func (s *snapshotStore) String() string {
+	return fmt.Sprintf("%v#%s", s.Store, s.id)
+}
+
+func (s *snapshotStore) object(key string, e SnapshotEntry) DstObject {
+	return DstObject{Key: key, Updated: e.Mtime, Size: e.Size, ETag: e.SHA256, Meta: copyMeta(e.Meta)}
+}
+
+// List lists the files of the snapshot, without the metadata, as S3.
+func (s *snapshotStore) List(prefix string, fn func(DstObject) error) error {
+	for key, e := range s.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		ob := s.object(key, e)
+		ob.Meta = nil
+		if err := fn(ob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshotStore) Head(key string) (DstObject, error) {
+	e, ok := s.entries[key]
+	if !ok {
+		return DstObject{}, ErrNotFound
+	}
+	return s.object(key, e), nil
+}
+
+func (s *snapshotStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, DstObject{}, ErrNotFound
+	}
+	if e.SHA256 == "" {
+		// links
+		return io.NopCloser(strings.NewReader("")), s.object(key, e), nil
+	}
+	r, _, err := s.Store.Get(s.c.contentKey(e.SHA256))
+	if err != nil {
+		return nil, DstObject{}, err
+	}
+	return r, s.object(key, e), nil
+}
+
+func (s *snapshotStore) Put(key string, r io.Reader, meta map[string]string) error {
+	return errReadOnly
+}
+
+func (s *snapshotStore) Delete(key string) error {
+	return errReadOnly
+}
+
+// openSnapshot sets the store of the run, as the files of the snapshot, if any, see SetSnapshot.
+func (c *Config) openSnapshot() error {
+	if c.snapshotID == "" {
+		return nil
+	}
+	if !c.mode.isRestore() {
+		return errors.New("a snapshot can only be restored")
+	}
+	if !c.asOf.IsZero() {
+		return errors.New("a snapshot cannot be restored as of a point in time")
+	}
+	snap, err := c.ReadSnapshot(c.snapshotID)
+	if err != nil {
+		return err
+	}
+	s := &snapshotStore{Store: c.store, c: c, id: snap.ID, entries: make(map[string]SnapshotEntry, len(snap.Entries))}
+	for _, e := range snap.Entries {
+		key := c.getKey(SrcFile{absPath: filepath.Join(c.prefix, filepath.FromSlash(e.Path))})
+		if key == "" {
+			return errors.New("invalid snapshot path " + e.Path)
+		}
+		s.entries[key] = e
+	}
+	c.store = s
+	return nil
+}
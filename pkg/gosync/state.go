@@ -0,0 +1,207 @@
+package gosync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateVersion is the version of the state file format.
+// A state file with another version is ignored, and rebuilt.
+const stateVersion = 1
+
+// stateEntry is the state of a file and its object, when last found identical.
+type stateEntry struct {
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	// Ctime is the file status change time, zero when unknown.
+	Ctime   time.Time `json:"ctime"`
+	ETag    string    `json:"etag"`
+	Updated time.Time `json:"updated"`
+	// Synced is when the entry was recorded.
+	Synced time.Time `json:"synced"`
+}
+
+// stateFile is the content of the state file.
+type stateFile struct {
+	Version int `json:"version"`
+	// Entries are keyed by the slash separated path, relative to the prefix.
+	Entries map[string]stateEntry `json:"entries"`
+}
+
+// stateCache is the local state database, loaded from, and saved to, the state file.
+// The entries recorded during a run replace the previous ones,
+// so that the files no longer walked are forgotten.
+// A nil stateCache never finds anything, and records nothing.
+type stateCache struct {
+	path string
+	// entries of the previous run.
+	old map[string]stateEntry
+	// entries of the current run.
+	lock sync.Mutex
+	next map[string]stateEntry
+}
+
+// loadState reads the state file. A missing file is an empty state.
+// With rescan, the previous content is ignored.
+func loadState(path string, rescan bool) (*stateCache, error) {
+	s := &stateCache{path: path, old: map[string]stateEntry{}, next: map[string]stateEntry{}}
+	if rescan {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var f stateFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return s, err
+	}
+	if f.Version == stateVersion && f.Entries != nil {
+		s.old = f.Entries
+	}
+	return s, nil
+}
+
+// changed checks if the file, or the object, changed since they were last found identical,
+// that is, since the last sync. A missing file or object, or a missing entry, is changed.
+func (s *stateCache) changed(rel string, sf *SrcFile, ob *DstObject) (fileChanged, objectChanged bool) {
+	if s == nil {
+		return true, true
+	}
+	e, ok := s.old[rel]
+	if !ok {
+		return true, true
+	}
+	fileChanged = sf == nil ||
+		e.Size != sf.size || !e.Mtime.Equal(sf.updated) || !e.Ctime.Equal(sf.ctime)
+	// S3 lists update times with more precision than Head provides them.
+	objectChanged = ob == nil ||
+		(ob.Size >= 0 && e.Size != ob.Size) || e.ETag != ob.ETag || (ob.ETag == "" && e.Updated.Unix() != ob.Updated.Unix())
+	return fileChanged, objectChanged
+}
+
+// synced checks if the file was synchronized by the last run.
+func (s *stateCache) synced(rel string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.old[rel]
+	return ok
+}
+
+// record records a file found identical to its object.
+func (s *stateCache) record(rel string, sf SrcFile, ob DstObject) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.next[rel] = stateEntry{
+		Size:    sf.size,
+		Mtime:   sf.updated,
+		Ctime:   sf.ctime,
+		ETag:    ob.ETag,
+		Updated: ob.Updated,
+		Synced:  time.Now().UTC(),
+	}
+}
+
+// forget removes the entry of a deleted file, or object.
+func (s *stateCache) forget(rel string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.next, rel)
+}
+
+// carry keeps the previous entries not recorded by the current run,
+// for a run that does not compare, or synchronize, all the files.
+func (s *stateCache) carry() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, e := range s.old {
+		if _, ok := s.next[k]; !ok {
+			s.next[k] = e
+		}
+	}
+}
+
+// save writes the entries of the current run into the state file,
+// and makes them the previous entries for the next run.
+// The file is written to a temporary file, then renamed.
+func (s *stateCache) save() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := json.Marshal(stateFile{Version: stateVersion, Entries: s.next})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	if err = os.MkdirAll(dir, 0o_0700); err != nil {
+		return err
+	}
+	tmp, err := createTemp(dir)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.old, s.next = s.next, map[string]stateEntry{}
+	return nil
+}
+
+// openState loads the state file upon the first run, if a state file is set.
+// A state file that cannot be read is rebuilt.
+func (c *Config) openState() {
+	if c.stateFile == "" || c.state != nil {
+		return
+	}
+	s, err := loadState(c.stateFile, c.rescan)
+	if err != nil {
+		c.log.Warn("invalid state file, rebuilding it", "path", c.stateFile, "error", err)
+	}
+	c.state = s
+}
+
+// relPath returns the slash separated path of the file, relative to the prefix.
+func (c *Config) relPath(sf SrcFile) string {
+	return strings.TrimPrefix(filepath.ToSlash(sf.absPath[len(c.prefix):]), "/")
+}
+
+// defaultStateFile returns a state file path in the user cache directory,
+// specific to the prefix, the store and the key prefix.
+func (c *Config) defaultStateFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\n%v\n%s", c.prefix, c.store, c.keyPrefix)))
+	return filepath.Join(dir, "go-s3sync", hex.EncodeToString(h[:8])+".json"), nil
+}
@@ -0,0 +1,44 @@
+package gosync
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by a Store when the requested key does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Store abstracts the destination object store.
+// The S3 bucket is one implementation, see NewS3Store.
+// Keys are provided by the Config, and are stored as is.
+type Store interface {
+	// List calls fn for every object whose key starts with prefix, in no particular order.
+	// Listing stops at the first error returned by fn, and returns it.
+	List(prefix string, fn func(DstObject) error) error
+	// Head describes the object, including its metadata, or returns ErrNotFound.
+	Head(key string) (DstObject, error)
+	// Get opens the object content for reading, and describes the object,
+	// including its metadata, or returns ErrNotFound.
+	// Caller must close the returned reader.
+	Get(key string) (io.ReadCloser, DstObject, error)
+	// Put creates or overwrites the object with the content of r,
+	// and the provided metadata, that may be nil.
+	// Metadata keys are lower case.
+	Put(key string, r io.Reader, meta map[string]string) error
+	// Delete removes the object.
+	Delete(key string) error
+}
+
+// Copier is implemented by the stores copying objects without transferring their content,
+// such as S3. Stores without it copy by Get and Put, see trashObject.
+type Copier interface {
+	// Copy copies the object, with its metadata, to dst, or returns ErrNotFound.
+	Copy(src, dst string) error
+}
+
+// nameHasher is implemented by the stores naming the contents, stored by their hash,
+// so that the names do not reveal the hashes, such as CryptStore.
+type nameHasher interface {
+	// hashName returns the name of a content, from its hex SHA-256.
+	hashName(sum string) string
+}
@@ -0,0 +1,102 @@
+package gosync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SymlinkPolicy selects how symbolic links are synchronized.
+type SymlinkPolicy int
+
+// SymlinkFollow synchronizes the target of the links, as if it was in place of the link.
+// Links to directories are walked, and loops are reported as failures.
+// SymlinkSkip ignores the links, as if they were excluded : they are never uploaded,
+// and the corresponding objects are never deleted, nor downloaded over them.
+// SymlinkStore stores the links as empty objects, with the link target in their metadata,
+// and recreates them as links upon restore.
+const (
+	SymlinkFollow SymlinkPolicy = iota
+	SymlinkSkip
+	SymlinkStore
+)
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SymlinkFollow:
+		return "follow"
+	case SymlinkSkip:
+		return "skip"
+	case SymlinkStore:
+		return "store"
+	default:
+		return "invalid(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+// Set parses the symlink policy, so that it can be used as a flag.
+func (p *SymlinkPolicy) Set(s string) error {
+	for _, m := range []SymlinkPolicy{SymlinkFollow, SymlinkSkip, SymlinkStore} {
+		if m.String() == s {
+			*p = m
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid symlink policy %q, use follow, skip or store", s)
+}
+
+// errSkipped reports a link skipped by the symlink policy.
+var errSkipped = errors.New("symbolic link skipped")
+
+// errLinkedParent reports a file below a linked directory, never written unless links are followed,
+// since it could be outside of the prefix directory.
+var errLinkedParent = errors.New("a parent directory is a symbolic link")
+
+// checkParents fails for a file below a linked directory, unless links are followed.
+func (c *Config) checkParents(absPath string) error {
+	if c.symlinks != SymlinkFollow && c.linkedParent(absPath) {
+		return errLinkedParent
+	}
+	return nil
+}
+
+// statFile describes the local file at absPath, applying the symlink policy.
+// It returns the file information, following the link if needed,
+// and the link target when the link itself is stored.
+// Skipped links are reported as errSkipped.
+// Unless links are followed, files below a linked directory are skipped, or missing.
+func (c *Config) statFile(absPath string) (info os.FileInfo, link string, err error) {
+	if c.symlinks != SymlinkFollow && c.linkedParent(absPath) {
+		// not walked, as if the file did not exist
+		if c.symlinks == SymlinkSkip {
+			return nil, "", errSkipped
+		}
+		return nil, "", &os.PathError{Op: "stat", Path: absPath, Err: os.ErrNotExist}
+	}
+	info, err = os.Lstat(absPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return info, "", err
+	}
+	switch c.symlinks {
+	case SymlinkSkip:
+		return nil, "", errSkipped
+	case SymlinkStore:
+		link, err = os.Readlink(absPath)
+		return info, link, err
+	default:
+		info, err = os.Stat(absPath)
+		return info, "", err
+	}
+}
+
+// linkedParent checks if one of the parent directories of absPath, inside the prefix, is a link.
+func (c *Config) linkedParent(absPath string) bool {
+	for dir := filepath.Dir(absPath); dir != c.prefix && isSubDir(c.prefix, dir); dir = filepath.Dir(dir) {
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
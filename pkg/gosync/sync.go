@@ -0,0 +1,443 @@
+package gosync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// workers is the number of workers comparing, or executing the actions, in parallel.
+const workers = 10
+
+// action is a single operation decided by the planner, see plan.
+type action struct {
+	// op is OpUpload, OpDownload, OpDeleteFile or OpDeleteObject.
+	op  Op
+	key string
+	// absPath is the local file path.
+	absPath string
+	// reason explains why the action is needed.
+	reason string
+	// the local file and the object, nil when missing.
+	file   *SrcFile
+	object *DstObject
+	// keepBoth renames the file before downloading, see ConflictKeepBoth.
+	keepBoth bool
+}
+
+// Reasons of the actions.
+const (
+	reasonLocalOnly  = "local only"
+	reasonRemoteOnly = "remote only"
+	reasonDiffer     = "differ"
+)
+
+// isDelete is true for the deletions.
+func (a *action) isDelete() bool {
+	return a.op == OpDeleteFile || a.op == OpDeleteObject
+}
+
+// size is the size of what is transferred, or deleted.
+func (a *action) size() int64 {
+	switch a.op {
+	case OpUpload, OpDeleteFile:
+		return a.file.size
+	default:
+		// unknown sizes are not counted, see DstObject
+		return max(a.object.Size, 0)
+	}
+}
+
+// diff pairs the local file and the object of a key, see plan.
+type diff struct {
+	key    string
+	file   *SrcFile
+	object *DstObject
+	// result of the comparison, when both exist.
+	same bool
+	err  error
+	// changes since the last sync, for the bidirectional modes.
+	fileChanged, objectChanged bool
+}
+
+// Sync synchronizes the files and the objects, according to the mode, in a single pass.
+// The actions are first planned, from the local walk and a single listing, see plan,
+// then executed by parallel workers. There is at most one action per key.
+// In the xxxMock modes, the actions are only reported.
+// With a ChunkStore, the runs storing objects hold a lock, see Prune.
+// It returns a Report of what was done.
+// Failures do not stop the processing, they are listed in the Report,
+// and returned as a *SyncError.
+func (c *Config) Sync() (*Report, error) {
+
+	if !c.mode.isSync() {
+		return nil, fmt.Errorf("invalid mode for synchronizing : %d", c.mode)
+	}
+	start := time.Now()
+	if err := c.startRun(); err != nil {
+		return nil, err
+	}
+	unlock, err := c.lockChunks()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c.log.Debug("sync started", "mode", c.mode.String())
+	actions, ok := c.plan()
+	if c.mode.isBidi() {
+		// keep the baseline of the actions not performed, or failed
+		c.state.carry()
+	}
+	if ok {
+		c.execute(actions)
+	}
+	if err := c.state.save(); err != nil {
+		c.fail(OpState, c.stateFile, err)
+	}
+	c.log.Debug("sync finished")
+
+	c.report.Elapsed = time.Since(start)
+	c.report.Failed = c.errs.list()
+	return c.report, c.errs.err()
+}
+
+// startRun prepares a new run, with a fresh filter, error list and report.
+func (c *Config) startRun() error {
+	f, err := c.newFilter()
+	if err != nil {
+		return err
+	}
+	c.filter = f
+	if err = c.checkTrash(); err != nil {
+		return err
+	}
+	c.store = c.baseStore()
+	if err = c.openAsOf(); err != nil {
+		return err
+	}
+	if err = c.openSnapshot(); err != nil {
+		return err
+	}
+	c.runID = time.Now().UTC().Format(runLayout)
+	c.errs = new(errorList)
+	c.report = c.newReport()
+	c.relinks = new(linkQueue)
+	c.inodes = make(map[inode]string)
+	if c.mode.isBidi() && c.stateFile == "" {
+		// the baseline is required
+		if c.stateFile, err = c.defaultStateFile(); err != nil {
+			return err
+		}
+	}
+	c.openState()
+	return nil
+}
+
+// plan compares the local files with the objects, and returns the actions needed, sorted by key.
+// The local walk and the listing run concurrently, and are merged by key :
+//   - local only : upload upon backup, delete the file upon restore,
+//   - remote only : delete the object upon backup, download upon restore,
+//   - both, different : upload upon backup, download upon restore,
+//   - both, same : nothing to do, counted as identical.
+//
+// Deletions are kept out of the plan when disabled, see SetNoDelete,
+// and abort the plan when above the limit, see SetMaxDeletions.
+// The bidirectional modes also use the last sync as a baseline, see decideBidi.
+// Files and objects found on both sides are compared in parallel, see compareDiff.
+// Nothing can be decided when the listing fails, when aborting upon conflicts,
+// or upon too many deletions, and ok is false.
+func (c *Config) plan() (actions []action, ok bool) {
+
+	c.files = make(chan SrcFile, 2000)
+	c.objects = make(chan DstObject, 2000)
+	files := make(map[string]*SrcFile)
+	objects := make(map[string]*DstObject)
+
+	wait := new(sync.WaitGroup)
+	wait.Add(3)
+	go c.walkFiles(wait)
+	var listErr error
+	go func() {
+		defer wait.Done()
+		listErr = c.walkObjects()
+	}()
+	go func() {
+		defer wait.Done()
+		for ob := range c.objects {
+			ob := ob
+			objects[ob.Key] = &ob
+		}
+	}()
+	for sf := range c.files {
+		sf := sf
+		files[c.getKey(sf)] = &sf
+	}
+	wait.Wait()
+	if listErr != nil {
+		c.fail(OpList, "", listErr)
+		return nil, false
+	}
+
+	// merge, by key
+	diffs := make([]*diff, 0, len(files)+len(objects))
+	for k, sf := range files {
+		diffs = append(diffs, &diff{key: k, file: sf, object: objects[k]})
+	}
+	for k, ob := range objects {
+		if files[k] == nil {
+			diffs = append(diffs, &diff{key: k, object: ob})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].key < diffs[j].key })
+	c.compare(diffs)
+
+	for _, d := range diffs {
+		a, ok := c.decide(d)
+		if ok && a.isDelete() && !c.deletes() {
+			count(&c.report.Kept, 1)
+			c.log.Info("deletion disabled, kept", "op", a.op, "key", a.key)
+			continue
+		}
+		if ok {
+			actions = append(actions, a)
+		}
+	}
+	if c.report.Conflicts > 0 && c.conflicts == ConflictAbort {
+		return nil, false
+	}
+	c.compared = len(diffs)
+	if !c.checkDeletions(actions, c.compared) {
+		return nil, false
+	}
+	c.trace("plan finished", "actions", len(actions))
+	return actions, true
+}
+
+// compare compares the files and objects found on both sides, in parallel.
+func (c *Config) compare(diffs []*diff) {
+	ch := make(chan *diff, 2000)
+	wait := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for d := range ch {
+				c.compareDiff(d)
+			}
+		}()
+	}
+	for _, d := range diffs {
+		if d.file != nil && d.object != nil {
+			ch <- d
+		}
+	}
+	close(ch)
+	wait.Wait()
+}
+
+// compareDiff compares a file and its object.
+// Unchanged files and objects since the last sync are the same, see stateCache.
+// In the bidirectional modes, a change on one side is enough to copy it to the other side,
+// and the contents are only compared when both changed, or when hashing.
+func (c *Config) compareDiff(d *diff) {
+	rel := c.relPath(*d.file)
+	d.fileChanged, d.objectChanged = c.state.changed(rel, d.file, d.object)
+	switch {
+	case !d.fileChanged && !d.objectChanged:
+		d.same = true
+	case c.mode.isBidi() && d.fileChanged != d.objectChanged && c.hashMode == HashNone:
+		// times cannot tell which side changed
+	default:
+		d.same, d.err = c.same(*d.file, *d.object)
+	}
+	if d.same {
+		c.state.record(rel, *d.file, *d.object)
+	}
+}
+
+// decide turns a diff into an action, if one is needed.
+func (c *Config) decide(d *diff) (action, bool) {
+	a := action{key: d.key, file: d.file, object: d.object}
+	if c.mode.isBidi() {
+		return a, c.decideBidi(d, &a)
+	}
+	backup := c.mode.isBackup()
+
+	switch {
+	case d.file != nil && d.object != nil:
+		if d.err != nil {
+			// Cannot decide, do nothing.
+			c.fail(OpHash, d.key, d.err)
+			return a, false
+		}
+		if d.same {
+			count(&c.report.Identical, 1)
+			c.log.Debug("identical", "key", d.key)
+			return a, false
+		}
+		a.absPath, a.reason = d.file.absPath, reasonDiffer
+		a.op = OpDownload
+		if backup {
+			a.op = OpUpload
+		}
+
+	case d.file != nil:
+		a.absPath, a.reason = d.file.absPath, reasonLocalOnly
+		a.op = OpDeleteFile
+		if backup {
+			a.op = OpUpload
+		}
+
+	default:
+		absPath, ok := c.remoteOnly(d)
+		if !ok {
+			return a, false
+		}
+		a.absPath, a.reason = absPath, reasonRemoteOnly
+		a.op = OpDownload
+		if backup {
+			a.op = OpDeleteObject
+		}
+	}
+	return a, true
+}
+
+// remoteOnly checks why the file of an object was not walked,
+// and returns its path if the file is really missing.
+func (c *Config) remoteOnly(d *diff) (string, bool) {
+	absPath, err := d.object.getAbsPath(c)
+	if err != nil {
+		c.fail(OpStat, d.key, err)
+		return "", false
+	}
+	if !c.mode.isBackup() {
+		// the object would be downloaded through the link
+		if err = c.checkParents(absPath); err != nil {
+			c.fail(OpDownload, absPath, err)
+			return "", false
+		}
+	}
+	fi, _, err := c.statFile(absPath)
+	if err == errSkipped {
+		// the link is left alone, as is its object
+		count(&c.report.Excluded, 1)
+		c.log.Debug("symbolic link skipped", "key", d.key)
+		return "", false
+	}
+	if err != nil && !os.IsNotExist(err) {
+		// Cannot decide, do nothing.
+		c.fail(OpStat, absPath, err)
+		return "", false
+	}
+	if err == nil && !fi.IsDir() {
+		// not a regular file, or not readable, see walkFiles.
+		c.log.Debug("file not walked, ignored", "key", d.key)
+		return "", false
+	}
+	return absPath, true
+}
+
+// execute executes the actions with parallel workers,
+// or only reports them in the xxxMock modes.
+// Hard links are restored last, see relink.
+func (c *Config) execute(actions []action) {
+	ch := make(chan *action, 2000)
+	wait := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go c.actionWorker(i, ch, wait)
+	}
+	for i := range actions {
+		ch <- &actions[i]
+	}
+	close(ch)
+	wait.Wait()
+	c.relink()
+}
+
+// actionWorker executes the actions from the channel.
+// There are typically multiple workers running in parallel.
+// It calls wait.Done() at the end.
+func (c *Config) actionWorker(i int, actions <-chan *action, wait *sync.WaitGroup) {
+
+	defer wait.Done()
+
+	c.trace("worker started", "worker", i)
+	for a := range actions {
+		n, err := a.size(), error(nil)
+		if !c.mode.isMock() {
+			n, err = c.do(a)
+		}
+		if a.op == OpUpload || a.op == OpDownload {
+			count(&c.report.BytesTransferred, n)
+		}
+		if err != nil {
+			c.fail(a.op, a.key, err)
+			continue
+		}
+		if !c.mode.isMock() {
+			c.recordSynced(a)
+		}
+		switch a.op {
+		case OpUpload:
+			count(&c.report.Uploads, 1)
+		case OpDownload:
+			count(&c.report.Downloads, 1)
+		default:
+			count(&c.report.Deletions, 1)
+		}
+		c.logAction(i, a.op, a.key, a.size())
+	}
+	c.trace("worker finished", "worker", i)
+}
+
+// do executes an action, returning the number of bytes transferred.
+func (c *Config) do(a *action) (int64, error) {
+	switch a.op {
+	case OpUpload:
+		return c.uploadFile(*a.file)
+	case OpDownload:
+		if a.keepBoth {
+			if err := os.Rename(a.absPath, conflictName(a.absPath, time.Now())); err != nil {
+				return 0, err
+			}
+		}
+		return c.downloadFile(SrcFile{absPath: a.absPath})
+	case OpDeleteFile:
+		return 0, c.deleteFile(*a.file)
+	case OpDeleteObject:
+		return 0, c.deleteObject(*a.object)
+	default:
+		return 0, errors.New("invalid action " + string(a.op))
+	}
+}
+
+// recordSynced records the file and its object after an action,
+// as the baseline of the next run, if a state file is used.
+func (c *Config) recordSynced(a *action) {
+	if c.state == nil {
+		return
+	}
+	rel := c.keyRel(a.key)
+	if a.isDelete() {
+		c.state.forget(rel)
+		return
+	}
+	info, link, err := c.statFile(a.absPath)
+	if err != nil {
+		return
+	}
+	ob, err := c.store.Head(a.key)
+	if err != nil {
+		return
+	}
+	sf := newSrcFile(a.absPath, info, link)
+	if a.file != nil && a.file.hardlink != "" && a.op == OpUpload {
+		sf.hardlink, sf.size = a.file.hardlink, 0
+	}
+	c.state.record(rel, sf, ob)
+}
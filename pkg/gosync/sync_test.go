@@ -0,0 +1,999 @@
+package gosync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackupMock(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), nil)
+
+	c.SetMode(ModeBackupMock)
+	c.run(t)
+
+	// nothing should have changed
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"/extra"}) {
+		t.Fatalf("store was modified : %v", keys)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), nil)
+
+	c.SetMode(ModeBackup)
+	c.run(t)
+
+	want := []string{"/a/b/two", "/a/one", "/three"}
+	if keys := m.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+	c.checkStoreContent(t, m)
+
+	// update a file, then backup again
+	c.writeFile("a/one", "one, updated")
+	c.run(t)
+	c.checkStoreContent(t, m)
+}
+
+func TestNoDelete(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), nil)
+
+	c.SetMode(ModeBackup).SetNoDelete(true)
+	if r := c.run(t); r.Uploads != 3 || r.Deletions != 0 || r.Kept != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	checkKeys(t, m, "/a/b/two", "/a/one", "/extra", "/three")
+
+	// additive modes
+	c.SetNoDelete(false).SetMode(ModeUploadOnly)
+	if r := c.run(t); r.Deletions != 0 || r.Kept != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	c.writeFile("local", "local")
+	c.SetMode(ModeDownloadOnly)
+	if r := c.run(t); r.Downloads != 1 || r.Deletions != 0 || r.Kept != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	want := []string{"a/b/two", "a/one", "extra", "local", "three"}
+	if files := c.listFiles(); !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+}
+
+func TestMaxDeletions(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	c.SetMode(ModeBackup)
+	c.run(t)
+
+	// backup of a wrong, empty, prefix
+	for _, f := range c.listFiles() {
+		os.Remove(filepath.Join(c.prefix, f))
+	}
+	var l DeletionLimit
+	if err := l.Set("50%"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMaxDeletions(l)
+	r, err := c.Sync()
+	se, ok := err.(*SyncError)
+	if !ok || len(se.Errors) != 3 || se.Errors[0].Op != OpDeleteObject || r.Deletions != 0 {
+		t.Fatalf("expected the 3 deletions to be refused, got : %v, %v", r, err)
+	}
+	checkKeys(t, m, "/a/b/two", "/a/one", "/three")
+
+	// within the limit
+	c.writeFile("a/one", "one")
+	c.writeFile("three", "three")
+	if err := l.Set("1"); err != nil || l.String() != "1" {
+		t.Fatal(l, err)
+	}
+	c.SetMaxDeletions(l)
+	if r = c.run(t); r.Deletions != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	for _, s := range []string{"0", "-1", "101%", "x"} {
+		if err := l.Set(s); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), map[string]string{"x": "y"})
+	trash := t.TempDir()
+
+	c.SetMode(ModeBackup).SetTrash(true).SetTrashDir(trash)
+	if r := c.run(t); r.Deletions != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	keys := m.Keys()
+	if len(keys) != 4 || !strings.HasPrefix(keys[3], "trash/") || !strings.HasSuffix(keys[3], "/extra") {
+		t.Fatalf("object not trashed : %v", keys)
+	}
+	if ob, err := m.Head(keys[3]); err != nil || ob.Meta["x"] != "y" {
+		t.Fatalf("metadata not trashed : %v, %v", ob, err)
+	}
+
+	// stores without Copier trash by Get and Put
+	m.Put("/extra2", bytes.NewReader([]byte("extra2")), map[string]string{"x": "z"})
+	c.SetStore(&headStore{Store: m})
+	if r := c.run(t); r.Deletions != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	c.SetStore(m)
+	if ob, err := m.Head(c.trashKey("/extra2")); err != nil || ob.Meta["x"] != "z" {
+		t.Fatalf("object not trashed : %v, %v", ob, err)
+	}
+
+	// trashed objects are not synchronized
+	c.SetMode(ModeRestore)
+	if r := c.run(t); r.Downloads != 0 || r.Deletions != 0 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	os.Remove(filepath.Join(c.prefix, "three"))
+	m.Delete("/a/one")
+	c.run(t)
+	if files := c.listFiles(); !reflect.DeepEqual(files, []string{"a/b/two", "three"}) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+	runs, _ := os.ReadDir(trash)
+	if len(runs) != 1 {
+		t.Fatalf("unexpected trash : %v", runs)
+	}
+	data, err := os.ReadFile(filepath.Join(trash, runs[0].Name(), "a", "one"))
+	if err != nil || string(data) != "one" {
+		t.Fatalf("file not trashed : %q, %v", data, err)
+	}
+
+	// a run in the same second does not overwrite the trash
+	c.writeFile("a/one", "one, again")
+	c.run(t)
+	if runs, _ = os.ReadDir(trash); len(runs) != 2 || runs[0].Name() == runs[1].Name() {
+		t.Fatalf("unexpected trash : %v", runs)
+	}
+	if data, err = os.ReadFile(filepath.Join(trash, runs[0].Name(), "a", "one")); err != nil || string(data) != "one" {
+		t.Fatalf("file not trashed : %q, %v", data, err)
+	}
+
+	// trash outside of the prefix only
+	if _, err := c.SetTrashDir(filepath.Join(c.prefix, "trash")).Sync(); err == nil {
+		t.Fatal("a trash inside the prefix should be refused")
+	}
+
+	// everything is purged
+	c.SetTrashDir(trash)
+	if r, err := c.PurgeTrash(-time.Minute); err != nil || r.Deletions != 4 {
+		t.Fatalf("unexpected purge : %v, %v", r, err)
+	}
+	checkKeys(t, m, "/a/b/two", "/three")
+	if runs, _ := os.ReadDir(trash); len(runs) != 0 {
+		t.Fatalf("trash not purged : %v", runs)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	src, m := newMemConfig(t)
+	m.SetVersioning(true)
+	src.createContent()
+	src.SetMode(ModeBackup)
+	src.run(t)
+	time.Sleep(10 * time.Millisecond)
+	then := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	src.writeFile("a/one", "one, updated")
+	src.writeFile("four", "four")
+	os.Remove(filepath.Join(src.prefix, "three"))
+	src.run(t)
+
+	vs, err := src.Versions("a/one")
+	if err != nil || len(vs) != 2 || !vs[0].Latest || vs[1].Latest || vs[1].Size != 3 {
+		t.Fatalf("unexpected versions : %v, %v", vs, err)
+	}
+	if vs, err = src.Versions("three"); err != nil || len(vs) != 2 || !vs[0].DeleteMarker {
+		t.Fatalf("unexpected versions : %v, %v", vs, err)
+	}
+
+	// restore the tree as it was
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m).SetMode(ModeRestore).SetAsOf(then)
+	dst.run(t)
+	if files := dst.listFiles(); !reflect.DeepEqual(files, []string{"a/b/two", "a/one", "three"}) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst.prefix, "a", "one")); string(data) != "one" {
+		t.Fatalf("unexpected content : %q", data)
+	}
+	if r := dst.run(t); r.Downloads != 0 || r.Identical != 3 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+
+	// latest versions
+	dst.SetAsOf(time.Time{})
+	dst.run(t)
+	dst.checkStoreContent(t, m)
+
+	dst.SetAsOf(then).SetMode(ModeBackup)
+	if _, err := dst.Sync(); err == nil {
+		t.Fatal("backup as of a point in time should be refused")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	src.SetMode(ModeSnapshot)
+	r, err := src.Snapshot()
+	if err != nil || r.Uploads != 3 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+
+	// each content is stored once
+	src.writeFile("a/one", "one, updated")
+	src.writeFile("four", "two, a bit longer")
+	if r, err = src.Snapshot(); err != nil || r.Uploads != 1 || r.Identical != 3 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+	ids, err := src.Snapshots()
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("unexpected snapshots : %v, %v", ids, err)
+	}
+	if n := len(m.Keys()); n != 6 {
+		t.Fatalf("unexpected keys : %v", m.Keys())
+	}
+
+	// restore the first snapshot, exactly
+	dst, _ := newMemConfig(t)
+	dst.writeFile("extra", "extra")
+	dst.SetStore(m).SetMode(ModeRestore).SetSnapshot(ids[0])
+	dst.run(t)
+	if files := dst.listFiles(); !reflect.DeepEqual(files, []string{"a/b/two", "a/one", "three"}) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst.prefix, "a", "one")); string(data) != "one" {
+		t.Fatalf("unexpected content : %q", data)
+	}
+	if r := dst.run(t); r.Downloads != 0 || r.Identical != 3 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+
+	dst.SetSnapshot("latest")
+	dst.run(t)
+	if files, want := dst.listFiles(), src.listFiles(); !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files : %v, expected %v", files, want)
+	}
+
+	// snapshots are ignored by the other modes
+	dst.SetSnapshot("").SetMode(ModeRestoreMock)
+	if r := dst.run(t); r.Downloads != 0 || r.Deletions != 4 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+}
+
+func TestSnapshotKeyPrefix(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	src.SetKeyPrefix("hosts/a").SetMode(ModeSnapshot)
+	if _, err := src.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	snapshots := m.Keys()
+
+	// a backup sharing the key prefix ignores the snapshots
+	src.SetMode(ModeBackup)
+	if r := src.run(t); r.Uploads != 3 || r.Deletions != 0 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	for _, k := range snapshots {
+		if _, err := m.Head(k); err != nil {
+			t.Fatalf("snapshot object %s deleted : %v", k, err)
+		}
+	}
+
+	// and refuses the files that would overwrite them
+	src.writeFile("snapshots/x.json", "x")
+	if r, err := src.Sync(); err == nil || r.Uploads != 0 || len(r.Failed) != 1 {
+		t.Fatalf("unexpected report : %v, %v", r, err)
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m).SetKeyPrefix("hosts/a").SetMode(ModeRestore)
+	if r := dst.run(t); r.Downloads != 3 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	if files := dst.listFiles(); !reflect.DeepEqual(files, []string{"a/b/two", "a/one", "three"}) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), nil)
+	m.Put("/a/one", bytes.NewReader([]byte("other")), nil)
+	m.Put("/three", bytes.NewReader(nil), nil)
+
+	c.SetMode(ModeBackup)
+	p, err := c.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, it := range p.Items {
+		got = append(got, string(it.Op)+" "+it.Key+" : "+it.Reason)
+	}
+	// the identical /three is not planned
+	want := []string{
+		"upload /a/b/two : local only",
+		"upload /a/one : differ",
+		"delete object /extra : remote only",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected plan : %q", got)
+	}
+	if p.Compared != 4 {
+		t.Fatalf("unexpected plan : %v", p)
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), nil)
+
+	c.SetMode(ModeBackupMock)
+	p, err := c.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err = p.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = ReadPlan(buf); err != nil || len(p.Items) != 4 || p.Mode != "backup" {
+		t.Fatalf("unexpected plan : %v, %v", p, err)
+	}
+	if len(m.Keys()) != 1 {
+		t.Fatal("planning should not change anything")
+	}
+
+	// the deletion limit applies to the plan
+	c.SetMaxDeletions(DeletionLimit{Percent: 10})
+	if r, err := c.Apply(p); err == nil || r.Uploads != 0 || r.Deletions != 0 {
+		t.Fatalf("the plan should be refused : %v, %v", r, err)
+	}
+	c.SetMaxDeletions(DeletionLimit{})
+
+	// a file changed since planning is refused
+	c.writeFile("a/one", "one, updated")
+	r, err := c.Apply(p)
+	se, ok := err.(*SyncError)
+	if !ok || len(se.Errors) != 1 || se.Errors[0].Key != "/a/one" || !errors.Is(se.Errors[0], errChanged) {
+		t.Fatalf("expected a single refused item, got : %v", err)
+	}
+	if r.Uploads != 2 || r.Deletions != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	checkKeys(t, m, "/a/b/two", "/three")
+}
+
+func TestRestoreMock(t *testing.T) {
+	c, m := newMemConfig(t)
+	m.Put("/a/one", bytes.NewReader([]byte("one")), nil)
+	c.writeFile("extra", "extra")
+
+	c.SetMode(ModeRestoreMock)
+	c.run(t)
+
+	// nothing should have changed
+	if files := c.listFiles(); !reflect.DeepEqual(files, []string{"extra"}) {
+		t.Fatalf("files were modified : %v", files)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	src.SetMode(ModeBackup)
+	src.run(t)
+
+	// restore into another, non empty, directory
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m)
+	dst.writeFile("extra", "extra")
+	dst.writeFile("a/one", "not the right content")
+
+	dst.SetMode(ModeRestore)
+	dst.run(t)
+
+	if files := dst.listFiles(); !reflect.DeepEqual(files, src.listFiles()) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+	dst.checkStoreContent(t, m)
+}
+
+func TestRestoreMtime(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	past := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(src.prefix, "a", "one"), past, past)
+	src.SetMode(ModeBackup)
+	src.run(t)
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m).SetMode(ModeRestore)
+	dst.run(t)
+
+	for _, f := range src.listFiles() {
+		i1, _ := os.Stat(filepath.Join(src.prefix, f))
+		i2, _ := os.Stat(filepath.Join(dst.prefix, f))
+		if !i1.ModTime().Equal(i2.ModTime()) {
+			t.Fatalf("modification time not restored for %s : %v vs %v", f, i1.ModTime(), i2.ModTime())
+		}
+	}
+
+	// the restored tree is identical to the bucket
+	if r := dst.run(t); r.Downloads != 0 {
+		t.Fatalf("nothing should be downloaded again : %v", r)
+	}
+	dst.SetMode(ModeBackup)
+	if r := dst.run(t); r.Uploads != 0 {
+		t.Fatalf("nothing should be uploaded again : %v", r)
+	}
+
+	// a same size object, with a newer stored time, is restored
+	src.writeFile("a/one", "ONE")
+	src.run(t)
+	dst.SetMode(ModeRestore)
+	if r := dst.run(t); r.Downloads != 1 {
+		t.Fatalf("the updated object should be downloaded : %v", r)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst.prefix, "a", "one")); string(data) != "ONE" {
+		t.Fatalf("unexpected content : %q", data)
+	}
+}
+
+func TestRestoreAttrs(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	one := filepath.Join(src.prefix, "a", "one")
+	os.Chmod(one, 0o_0750)
+	src.SetMode(ModeBackup).SetKeepAttrs(true)
+	src.run(t)
+
+	ob, err := m.Head("/a/one")
+	if err != nil || ob.Meta[metaMode] != "0750" {
+		t.Fatalf("mode not stored : %v, %v", ob.Meta, err)
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m).SetMode(ModeRestore).SetKeepAttrs(true)
+	dst.run(t)
+	info, err := os.Stat(filepath.Join(dst.prefix, "a", "one"))
+	if err != nil || info.Mode().Perm() != 0o_0750 {
+		t.Fatalf("mode not restored : %v, %v", info.Mode(), err)
+	}
+
+	// an owner that cannot be restored is not compared
+	defer func(f func() bool) { canChown = f }(canChown)
+	canChown = func() bool { return false }
+	r, ob, _ := m.Get("/a/one")
+	ob.Meta[metaUID] = "12345"
+	m.Put("/a/one", r, ob.Meta)
+	if r := dst.run(t); r.Downloads != 0 {
+		t.Fatalf("nothing should be downloaded again : %v", r)
+	}
+
+	// a change of mode alone is uploaded
+	os.Chmod(one, 0o_0600)
+	if r := src.run(t); r.Uploads != 1 {
+		t.Fatalf("the mode change should be uploaded : %v", r)
+	}
+	if r := src.run(t); r.Uploads != 0 {
+		t.Fatalf("nothing should be uploaded again : %v", r)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	os.Symlink("one", filepath.Join(src.prefix, "a", "link"))
+	os.Symlink("a", filepath.Join(src.prefix, "dirlink"))
+
+	// follow
+	src.SetMode(ModeBackup)
+	src.run(t)
+	checkKeys(t, m, "/a/b/two", "/a/link", "/a/one", "/dirlink/b/two", "/dirlink/link", "/dirlink/one", "/three")
+
+	// skip, the objects are left alone
+	src.SetSymlinkPolicy(SymlinkSkip)
+	if r := src.run(t); r.Uploads != 0 || r.Deletions != 0 {
+		t.Fatalf("skipped links should not be synchronized : %v", r)
+	}
+
+	// store
+	src.SetSymlinkPolicy(SymlinkStore)
+	src.run(t)
+	checkKeys(t, m, "/a/b/two", "/a/link", "/a/one", "/dirlink", "/three")
+	if ob, _ := m.Head("/a/link"); ob.Size != 0 || ob.Meta[metaSymlink] != "one" {
+		t.Fatalf("link not stored : %v %v", ob, ob.Meta)
+	}
+	if r := src.run(t); r.Uploads != 0 {
+		t.Fatalf("nothing should be uploaded again : %v", r)
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m).SetMode(ModeRestore).SetSymlinkPolicy(SymlinkStore)
+	dst.run(t)
+	if target, err := os.Readlink(filepath.Join(dst.prefix, "dirlink")); err != nil || target != "a" {
+		t.Fatalf("link not restored : %q, %v", target, err)
+	}
+	if r := dst.run(t); r.Downloads != 0 {
+		t.Fatalf("nothing should be downloaded again : %v", r)
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	os.Symlink("..", filepath.Join(c.prefix, "a", "up"))
+	c.SetMode(ModeBackup)
+	_, err := c.Sync()
+	if err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Fatalf("the loop should be reported : %v", err)
+	}
+	checkKeys(t, m, "/a/b/two", "/a/one", "/three")
+}
+
+func TestSymlinkEscape(t *testing.T) {
+	c, m := newMemConfig(t)
+	outside := t.TempDir()
+	m.Put("/lnk", strings.NewReader(""), map[string]string{metaSymlink: outside})
+	c.SetMode(ModeRestore).SetSymlinkPolicy(SymlinkStore)
+	c.run(t)
+	m.Put("/lnk/evil", strings.NewReader("evil"), nil)
+	if _, err := c.Sync(); err == nil || !strings.Contains(err.Error(), errLinkedParent.Error()) {
+		t.Fatalf("the linked parent should be reported : %v", err)
+	}
+	if files, _ := os.ReadDir(outside); len(files) != 0 {
+		t.Fatalf("files written outside of the prefix : %v", files)
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	src, m := newMemConfig(t)
+	src.createContent()
+	os.Link(filepath.Join(src.prefix, "a", "b", "two"), filepath.Join(src.prefix, "a", "b", "two2"))
+	os.Link(filepath.Join(src.prefix, "a", "b", "two"), filepath.Join(src.prefix, "four"))
+	src.SetMode(ModeBackup)
+	if r := src.run(t); r.BytesTransferred != 20 {
+		t.Fatalf("the content should be uploaded once : %v", r)
+	}
+	checkKeys(t, m, "/a/b/two", "/a/b/two2", "/a/one", "/four", "/three")
+	if ob, _ := m.Head("/four"); ob.Size != 0 || ob.Meta[metaHardlink] != "a/b/two" {
+		t.Fatalf("hard link not stored : %v %v", ob, ob.Meta)
+	}
+	if r := src.run(t); r.Uploads != 0 {
+		t.Fatalf("nothing should be uploaded again : %v", r)
+	}
+
+	dst, _ := newMemConfig(t)
+	dst.SetStore(m).SetMode(ModeRestore)
+	dst.run(t)
+	i1, _ := os.Stat(filepath.Join(dst.prefix, "a", "b", "two"))
+	for _, f := range []string{"a/b/two2", "four"} {
+		i2, err := os.Stat(filepath.Join(dst.prefix, f))
+		if err != nil || !os.SameFile(i1, i2) {
+			t.Fatalf("hard link %s not restored : %v", f, err)
+		}
+	}
+	if r := dst.run(t); r.Downloads != 0 {
+		t.Fatalf("nothing should be downloaded again : %v", r)
+	}
+}
+
+func TestStateCache(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	h := &headStore{Store: m}
+	state := filepath.Join(t.TempDir(), "state.json")
+	c.SetStore(h).SetHashMode(HashSHA256).SetStateFile(state).SetMode(ModeBackup)
+	c.run(t)
+	c.run(t) // records the identical files
+
+	rerun := func() *Report {
+		t.Helper()
+		h.heads = 0
+		r, err := c.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if r := rerun(); h.heads != 0 || r.Identical != 3 {
+		t.Fatalf("files should be decided from the cache, %d heads : %v", h.heads, r)
+	}
+
+	// a modified file is uploaded
+	c.writeFile("a/one", "eno")
+	if r := rerun(); r.Uploads != 1 {
+		t.Fatalf("the modified file should be uploaded : %v", r)
+	}
+
+	// reloaded from the state file
+	c.SetStateFile(state)
+	rerun()
+	if r := rerun(); h.heads != 0 || r.Identical != 3 {
+		t.Fatalf("files should be decided from the state file, %d heads : %v", h.heads, r)
+	}
+
+	c.SetRescan(true)
+	if rerun(); h.heads != 3 {
+		t.Fatalf("files should be compared again, %d heads", h.heads)
+	}
+}
+
+func TestBidirectional(t *testing.T) {
+	// two directories synchronized through the same store
+	a, m := newMemConfig(t)
+	b, _ := newMemConfig(t)
+	a.SetStore(m).SetStateFile(filepath.Join(t.TempDir(), "a.json")).SetMode(ModeBidirectional)
+	b.SetStore(m).SetStateFile(filepath.Join(t.TempDir(), "b.json")).SetMode(ModeBidirectional)
+
+	a.createContent()
+	a.run(t)
+	b.writeFile("four", "four")
+	b.run(t)
+	a.run(t)
+	want := []string{"a/b/two", "a/one", "four", "three"}
+	if fa, fb := a.listFiles(), b.listFiles(); !reflect.DeepEqual(fa, want) || !reflect.DeepEqual(fb, want) {
+		t.Fatalf("unexpected files : %v, %v", fa, fb)
+	}
+
+	// changes and deletions propagate both ways
+	a.writeFile("a/one", "one, updated")
+	os.Remove(filepath.Join(b.prefix, "three"))
+	a.run(t)
+	if r := b.run(t); r.Downloads != 1 || r.Deletions != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	a.run(t)
+	want = []string{"a/b/two", "a/one", "four"}
+	if fa, fb := a.listFiles(), b.listFiles(); !reflect.DeepEqual(fa, want) || !reflect.DeepEqual(fb, want) {
+		t.Fatalf("unexpected files : %v, %v", fa, fb)
+	}
+	checkKeys(t, m, "/a/b/two", "/a/one", "/four")
+	b.checkStoreContent(t, m)
+
+	// a conflict is reported, and nothing is done
+	a.writeFile("four", "four, from a")
+	a.run(t)
+	b.writeFile("four", "four, from b")
+	b.SetConflictPolicy(ConflictAbort)
+	r, err := b.Sync()
+	se, ok := err.(*SyncError)
+	if !ok || len(se.Errors) != 1 || se.Errors[0].Op != OpConflict || r.Conflicts != 1 || r.Uploads != 0 {
+		t.Fatalf("expected a single conflict, got : %v, %v", r, err)
+	}
+
+	// both sides are kept
+	b.SetConflictPolicy(ConflictKeepBoth)
+	if r = b.run(t); r.Downloads != 1 || r.Conflicts != 1 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	b.run(t)
+	a.run(t)
+	files := a.listFiles()
+	if len(files) != 4 || !strings.HasPrefix(files[3], "four.conflict-") {
+		t.Fatalf("unexpected files : %v", files)
+	}
+	a.checkStoreContent(t, m)
+	b.checkStoreContent(t, m)
+}
+
+func TestConflictName(t *testing.T) {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for in, want := range map[string]string{
+		"/a/b.txt": "/a/b.conflict-20200102-030405.txt",
+		"/a/b":     "/a/b.conflict-20200102-030405",
+		"/a/.b":    "/a/.b.conflict-20200102-030405",
+	} {
+		if got := conflictName(in, tm); got != want {
+			t.Fatalf("conflictName(%q) : %q, expected %q", in, got, want)
+		}
+	}
+}
+
+func TestBackupRestoreDir(t *testing.T) {
+	src, _ := newMemConfig(t)
+	dst, _ := newMemConfig(t)
+
+	// use the dst directory as the store for src
+	d := NewDirStore(filepath.Join(dst.prefix, "store"))
+	src.SetStore(d)
+	src.createContent()
+	src.SetMode(ModeBackup)
+	src.run(t)
+
+	for _, f := range src.listFiles() {
+		if _, err := d.Head("/" + f); err != nil {
+			t.Fatal(f, err)
+		}
+	}
+	if r := src.run(t); r.Uploads != 0 || r.Identical != 3 {
+		t.Fatalf("nothing should be uploaded again : %v", r)
+	}
+
+	// remove a file, it should be deleted from the store
+	os.Remove(filepath.Join(src.prefix, "a", "one"))
+	src.run(t)
+	if _, err := d.Head("/a/one"); err != ErrNotFound {
+		t.Fatal("object should have been deleted : ", err)
+	}
+
+	// restore into an empty directory
+	res, _ := newMemConfig(t)
+	res.SetStore(d)
+	res.SetMode(ModeRestore)
+	res.run(t)
+	if files := res.listFiles(); !reflect.DeepEqual(files, src.listFiles()) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+}
+
+func TestBackupReport(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	m.Put("/extra", bytes.NewReader([]byte("extra")), nil)
+
+	c.SetMode(ModeBackup)
+	r := c.run(t)
+	want := Report{Mode: c.mode.String(), FilesScanned: 3, ObjectsListed: 1,
+		Uploads: 3, Deletions: 1, BytesTransferred: 20, Failed: []*OpError{}}
+	r.Elapsed = 0
+	if !reflect.DeepEqual(*r, want) {
+		t.Fatalf("unexpected report : %#v", r)
+	}
+
+	// nothing to do the second time
+	r = c.run(t)
+	if r.Uploads != 0 || r.Identical != 3 || r.ObjectsListed != 3 {
+		t.Fatalf("unexpected report : %#v", r)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	c1, m := newMemConfig(t)
+	c1.SetKeyPrefix("/hosts/one")
+	c1.createContent()
+
+	c2, _ := newMemConfig(t)
+	c2.SetStore(m).SetKeyPrefix("hosts/one2/")
+	c2.writeFile("other", "other")
+
+	c1.SetMode(ModeBackup)
+	c1.run(t)
+	c2.SetMode(ModeBackup)
+	c2.run(t)
+
+	// backing up a tree leaves the other one alone
+	want := []string{"hosts/one/a/b/two", "hosts/one/a/one", "hosts/one/three", "hosts/one2/other"}
+	if keys := m.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+
+	// restore the first tree only
+	res, _ := newMemConfig(t)
+	res.SetStore(m).SetKeyPrefix("hosts/one")
+	res.SetMode(ModeRestore)
+	res.run(t)
+	if files := res.listFiles(); !reflect.DeepEqual(files, c1.listFiles()) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	c, _ := newMemConfig(t)
+	c.createContent()
+
+	buf := new(bytes.Buffer)
+	c.SetLogger(slog.New(slog.NewTextHandler(buf, nil)))
+	c.SetMode(ModeBackupMock)
+	c.run(t)
+
+	for _, key := range []string{"/a/one", "/a/b/two", "/three"} {
+		if !strings.Contains(buf.String(), "msg=upload op=upload key="+key+" ") {
+			t.Fatalf("upload of %s not logged : %s", key, buf)
+		}
+	}
+	if strings.Contains(buf.String(), "worker started") {
+		t.Fatalf("workers chatter should not be logged : %s", buf)
+	}
+}
+
+func TestBackupFailures(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	c.SetStore(&failStore{Store: m, key: "/a/one", op: OpUpload})
+
+	c.SetMode(ModeBackup)
+	r, err := c.Sync()
+	se, ok := err.(*SyncError)
+	if !ok || len(se.Errors) != 1 {
+		t.Fatalf("expected a single failure, got : %v", err)
+	}
+	if se.Errors[0].Op != OpUpload || se.Errors[0].Key != "/a/one" {
+		t.Fatalf("unexpected failure : %v", se.Errors[0])
+	}
+	if len(r.Failed) != 1 || r.Uploads != 2 {
+		t.Fatalf("unexpected report : %v", r)
+	}
+	// other files were processed
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"/a/b/two", "/three"}) {
+		t.Fatalf("unexpected keys : %v", keys)
+	}
+}
+
+func TestRestoreFailures(t *testing.T) {
+	c, m := newMemConfig(t)
+	c.createContent()
+	c.SetStore(&failStore{Store: m, op: OpList})
+
+	// the files are not deleted when the objects are unknown
+	c.SetMode(ModeRestore)
+	_, err := c.Sync()
+	se, ok := err.(*SyncError)
+	if !ok || len(se.Errors) != 1 || se.Errors[0].Op != OpList {
+		t.Fatalf("expected a single list failure, got : %v", err)
+	}
+	if files := c.listFiles(); !reflect.DeepEqual(files, []string{"a/b/two", "a/one", "three"}) {
+		t.Fatalf("unexpected files : %v", files)
+	}
+}
+
+// ************* utilities ******************
+
+// failStore is a Store failing the op operation on key, or any listing.
+type failStore struct {
+	Store
+	key string
+	op  Op
+}
+
+var errFailStore = errors.New("failStore error")
+
+func (f *failStore) List(prefix string, fn func(DstObject) error) error {
+	if f.op == OpList {
+		return errFailStore
+	}
+	return f.Store.List(prefix, fn)
+}
+
+func (f *failStore) Head(key string) (DstObject, error) {
+	if key == f.key && f.op == OpHead {
+		return DstObject{}, errFailStore
+	}
+	return f.Store.Head(key)
+}
+
+func (f *failStore) Put(key string, r io.Reader, meta map[string]string) error {
+	if key == f.key && f.op == OpUpload {
+		return errFailStore
+	}
+	return f.Store.Put(key, r, meta)
+}
+
+// headStore is a Store counting the Head requests.
+type headStore struct {
+	Store
+	heads int64
+}
+
+func (h *headStore) Head(key string) (DstObject, error) {
+	atomic.AddInt64(&h.heads, 1)
+	return h.Store.Head(key)
+}
+
+// run synchronizes, failing on any error.
+func (c tConfig) run(t *testing.T) *Report {
+	t.Helper()
+	r, err := c.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// newMemConfig creates a test configuration,
+// syncing a new temporary directory, removed with the test, with a new MemStore.
+func newMemConfig(t *testing.T) (tConfig, *MemStore) {
+	m := NewMemStore()
+	c := tConfig{NewDefaultConfig().SetStore(m).SetLogLevel(slog.LevelError)}
+	c.prefix = t.TempDir()
+	return c, m
+}
+
+// writeFile creates or overwrites a file, creating dirs as needed.
+// name is slash separated, relative to the prefix.
+func (c tConfig) writeFile(name string, content string) {
+	p := filepath.Join(c.prefix, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), c.dirPerm); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o_0644); err != nil {
+		panic(err)
+	}
+}
+
+// createContent creates a few files in nested dirs.
+func (c tConfig) createContent() {
+	c.writeFile("a/one", "one")
+	c.writeFile("a/b/two", "two, a bit longer")
+	c.writeFile("three", "")
+	os.MkdirAll(filepath.Join(c.prefix, "empty"), c.dirPerm)
+}
+
+// listFiles lists the sorted relative names of all files.
+func (c tConfig) listFiles() []string {
+	var files []string
+	filepath.Walk(c.prefix, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(c.prefix, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+// checkKeys verifies the store keys, in lexical order.
+func checkKeys(t *testing.T, m *MemStore, keys ...string) {
+	t.Helper()
+	if got := m.Keys(); !reflect.DeepEqual(got, keys) {
+		t.Fatalf("unexpected keys %v, expected %v", got, keys)
+	}
+}
+
+// checkStoreContent verifies each file has the same content as its object.
+func (c tConfig) checkStoreContent(t *testing.T, m *MemStore) {
+	t.Helper()
+	for _, f := range c.listFiles() {
+		data, err := os.ReadFile(filepath.Join(c.prefix, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _, err := m.Get("/" + f)
+		if err != nil {
+			t.Fatal(f, err)
+		}
+		obj, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, obj) {
+			t.Fatalf("content differs for %s : %q vs %q", f, data, obj)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package gosync
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// trashKeyPrefix is the key prefix of the trashed objects, see SetTrash.
+// An object is moved to trash/<run id>/<key>, without the leading slash of the key.
+const trashKeyPrefix = "trash/"
+
+// runLayout formats the run ids, naming the trash directories and key prefixes,
+// the snapshots and the locks, with nanoseconds, so that two runs never share a trash directory.
+// trashLayout parses them, as well as the ids in seconds of the previous versions.
+const (
+	trashLayout = "20060102-150405"
+	runLayout   = trashLayout + ".000000000"
+)
+
+// defaultTrashDir returns the local trash directory, a sibling of the prefix directory.
+func (c *Config) defaultTrashDir() string {
+	return filepath.Join(filepath.Dir(c.prefix), "."+filepath.Base(c.prefix)+".trash")
+}
+
+// checkTrash sets the trash directory of the run, outside of the prefix directory.
+func (c *Config) checkTrash() error {
+	if !c.trash {
+		return nil
+	}
+	dir := c.trashDir
+	if dir == "" {
+		dir = c.defaultTrashDir()
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if isSubDir(c.prefix, dir) {
+		return errors.New("the trash directory should be outside of the prefix directory : " + dir)
+	}
+	c.trashDir = dir
+	return nil
+}
+
+// trashFile moves a deleted file into the trash directory, under the run id,
+// keeping its path relative to the prefix.
+func (c *Config) trashFile(absPath string) error {
+	rel, err := filepath.Rel(c.prefix, absPath)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(c.trashDir, c.runID, rel)
+	if err = os.MkdirAll(filepath.Dir(dst), c.dirPerm); err != nil {
+		return err
+	}
+	err = os.Rename(absPath, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		// the trash is on another device
+		if err = copyFile(absPath, dst); err == nil {
+			err = os.Remove(absPath)
+		}
+	}
+	return err
+}
+
+// copyFile copies a file, or a link, with its modification time.
+func copyFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// trashKey returns the key an object is moved to, by the current run.
+func (c *Config) trashKey(key string) string {
+	return trashKeyPrefix + c.runID + "/" + strings.TrimPrefix(key, "/")
+}
+
+// trashObject moves a deleted object, with its metadata, under the trash key prefix,
+// copied by the store if possible, without transferring the content, see Copier.
+func (c *Config) trashObject(key string) error {
+	if cp, ok := c.store.(Copier); ok {
+		if err := cp.Copy(key, c.trashKey(key)); err != nil {
+			return err
+		}
+		return c.store.Delete(key)
+	}
+	r, ob, err := c.store.Get(key)
+	if err != nil {
+		return err
+	}
+	err = c.store.Put(c.trashKey(key), r, ob.Meta)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return c.store.Delete(key)
+}
+
+// PurgeTrash permanently deletes the trashed files and objects older than retention,
+// that is, moved to the trash by runs started before.
+// Only the objects trashed within the key prefix are deleted.
+// Failures do not stop the processing, they are listed in the Report,
+// and returned as a *SyncError.
+func (c *Config) PurgeTrash(retention time.Duration) (*Report, error) {
+
+	start := time.Now()
+	c.errs = new(errorList)
+	c.report = c.newReport()
+	if err := c.checkTrash(); err != nil {
+		return nil, err
+	}
+	before := start.Add(-retention)
+	expired := func(runID string) bool {
+		t, err := time.Parse(trashLayout, runID)
+		return err == nil && t.Before(before)
+	}
+
+	c.log.Debug("purge started", "dir", c.trashDir, "before", before)
+	runs, err := os.ReadDir(c.trashDir)
+	if err != nil && !os.IsNotExist(err) {
+		c.fail(OpWalk, c.trashDir, err)
+	}
+	for _, run := range runs {
+		if !run.IsDir() || !expired(run.Name()) {
+			continue
+		}
+		dir := filepath.Join(c.trashDir, run.Name())
+		var n int64
+		filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				n++
+			}
+			return nil
+		})
+		if err := os.RemoveAll(dir); err != nil {
+			c.fail(OpDeleteFile, dir, err)
+			continue
+		}
+		count(&c.report.Deletions, n)
+		c.log.Info("purged", "op", OpDeleteFile, "dir", dir, "files", n)
+	}
+
+	var keys []string
+	err = c.store.List(trashKeyPrefix, func(ob DstObject) error {
+		count(&c.report.ObjectsListed, 1)
+		runID, key, ok := strings.Cut(strings.TrimPrefix(ob.Key, trashKeyPrefix), "/")
+		if ok && expired(runID) && strings.HasPrefix(key, c.keyPrefix) {
+			keys = append(keys, ob.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		c.fail(OpList, trashKeyPrefix, err)
+	}
+	for _, key := range keys {
+		if err := c.store.Delete(key); err != nil {
+			c.fail(OpDeleteObject, key, err)
+			continue
+		}
+		count(&c.report.Deletions, 1)
+		c.logAction(0, OpDeleteObject, key, 0)
+	}
+	c.log.Debug("purge finished")
+
+	c.report.Elapsed = time.Since(start)
+	c.report.Failed = c.errs.list()
+	return c.report, c.errs.err()
+}
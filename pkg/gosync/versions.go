@@ -0,0 +1,216 @@
+package gosync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ObjectVersion describes a version of an object, or a delete marker.
+type ObjectVersion struct {
+	DstObject
+	// VersionID identifies the version in the store.
+	VersionID string
+	// Latest is true for the current version.
+	Latest bool
+	// DeleteMarker is true when the object was deleted, without content.
+	DeleteMarker bool
+}
+
+// VersionedStore is a Store keeping the previous versions of its objects,
+// such as an S3 bucket with versioning enabled. See SetAsOf and Versions.
+type VersionedStore interface {
+	Store
+	// ListVersions calls fn for every version, and delete marker,
+	// of the objects whose key starts with prefix, in no particular order.
+	// As List, listings do not provide the metadata.
+	ListVersions(prefix string, fn func(ObjectVersion) error) error
+	// HeadVersion describes a version of the object, including its metadata, or returns ErrNotFound.
+	HeadVersion(key, versionID string) (DstObject, error)
+	// GetVersion opens a version of the object for reading, see Get.
+	GetVersion(key, versionID string) (io.ReadCloser, DstObject, error)
+}
+
+// errReadOnly is returned when modifying a store view, see storeView.
+var errReadOnly = errors.New("the store is read only, restoring a point in time or a snapshot")
+
+// asOfStore is a read only view of a VersionedStore, as it was at a point in time.
+// Each object is seen in its last version before that time, if not deleted then.
+type asOfStore struct {
+	VersionedStore
+	asOf time.Time
+	// versions found by the last listing, by key.
+	lock     sync.Mutex
+	versions map[string]ObjectVersion
+}
+
+func (s *asOfStore) String() string {
+	return fmt.Sprintf("%v@%s", s.VersionedStore, s.asOf.UTC().Format(time.RFC3339))
+}
+
+// pick keeps the last version of each key before the point in time.
+func (s *asOfStore) pick(versions map[string]ObjectVersion, v ObjectVersion) {
+	if v.Updated.After(s.asOf) {
+		return
+	}
+	if old, ok := versions[v.Key]; !ok || v.Updated.After(old.Updated) {
+		versions[v.Key] = v
+	}
+}
+
+// List lists the objects as they were, and remembers their versions.
+func (s *asOfStore) List(prefix string, fn func(DstObject) error) error {
+	versions := make(map[string]ObjectVersion)
+	err := s.ListVersions(prefix, func(v ObjectVersion) error {
+		s.pick(versions, v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.versions = versions
+	s.lock.Unlock()
+	for _, v := range versions {
+		if v.DeleteMarker {
+			continue
+		}
+		if err = fn(v.DstObject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// version returns the version of the object at the point in time,
+// from the last listing, or listing the versions of the key.
+func (s *asOfStore) version(key string) (string, error) {
+	s.lock.Lock()
+	v, ok := s.versions[key]
+	s.lock.Unlock()
+	if !ok {
+		versions := make(map[string]ObjectVersion)
+		err := s.ListVersions(key, func(v ObjectVersion) error {
+			if v.Key == key {
+				s.pick(versions, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		v, ok = versions[key]
+	}
+	if !ok || v.DeleteMarker {
+		return "", ErrNotFound
+	}
+	return v.VersionID, nil
+}
+
+func (s *asOfStore) Head(key string) (DstObject, error) {
+	id, err := s.version(key)
+	if err != nil {
+		return DstObject{}, err
+	}
+	return s.HeadVersion(key, id)
+}
+
+func (s *asOfStore) Get(key string) (io.ReadCloser, DstObject, error) {
+	id, err := s.version(key)
+	if err != nil {
+		return nil, DstObject{}, err
+	}
+	return s.GetVersion(key, id)
+}
+
+func (s *asOfStore) Put(key string, r io.Reader, meta map[string]string) error {
+	return errReadOnly
+}
+
+func (s *asOfStore) Delete(key string) error {
+	return errReadOnly
+}
+
+// storeView is a read only view of a store, set for a run, see SetAsOf and SetSnapshot.
+type storeView interface {
+	// base returns the viewed store.
+	base() Store
+}
+
+func (s *asOfStore) base() Store {
+	return s.VersionedStore
+}
+
+// baseStore returns the configured store, without the view set by a previous run, if any.
+func (c *Config) baseStore() Store {
+	s := c.store
+	for v, ok := s.(storeView); ok; v, ok = s.(storeView) {
+		s = v.base()
+	}
+	return s
+}
+
+// versionedStore returns the configured store, if it keeps versions.
+func (c *Config) versionedStore() (VersionedStore, error) {
+	s := c.baseStore()
+	vs, ok := s.(VersionedStore)
+	if !ok {
+		return nil, fmt.Errorf("the store %v does not keep versions", s)
+	}
+	return vs, nil
+}
+
+// openAsOf sets the store of the run, as of the point in time, if any, see SetAsOf.
+func (c *Config) openAsOf() error {
+	if c.asOf.IsZero() {
+		return nil
+	}
+	if !c.mode.isRestore() {
+		return errors.New("only a restore can be done as of a point in time")
+	}
+	vs, err := c.versionedStore()
+	if err != nil {
+		return err
+	}
+	c.store = &asOfStore{VersionedStore: vs, asOf: c.asOf}
+	return nil
+}
+
+// Versions lists the versions of the object of a file, newest first, including the delete markers.
+// The path is relative to the prefix directory, unless absolute.
+func (c *Config) Versions(path string) ([]ObjectVersion, error) {
+	vs, err := c.versionedStore()
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.prefix, path)
+	}
+	key := c.getKey(SrcFile{absPath: filepath.Clean(path)})
+	if key == "" {
+		return nil, errors.New("file is outside of the prefix directory : " + path)
+	}
+	var versions []ObjectVersion
+	err = vs.ListVersions(key, func(v ObjectVersion) error {
+		if v.Key == key {
+			versions = append(versions, v)
+		}
+		return nil
+	})
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Updated.After(versions[j].Updated) })
+	return versions, err
+}
+
+// parseTime parses a point in time, as RFC 3339, or as a UTC date, with or without the time.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339, such as 2020-01-02T15:04:05Z, or a UTC date", s)
+}
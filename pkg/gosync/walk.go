@@ -0,0 +1,139 @@
+package gosync
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// walkFiles walks the prefix directory, and sends the files through the files channel, see plan.
+// Directories are ignored, only the files inside are processed.
+// Excluded files or directories are skipped, see filter.
+// Symbolic links are handled according to the symlink policy, see statFile.
+// Files already walked under another hard link are sent as links to the first one.
+// Files or directories that cannot be read, and files whose key is reserved, see isReservedKey,
+// are recorded as failed, and skipped.
+// It will closes channel and calls c.wait.Done() at the end.
+func (c *Config) walkFiles(wait *sync.WaitGroup) {
+
+	defer wait.Done()
+	defer close(c.files)
+
+	info, err := os.Stat(c.prefix)
+	if err != nil {
+		c.fail(OpWalk, c.prefix, err)
+		return
+	}
+	c.walkDir(c.prefix, "", []os.FileInfo{info})
+
+	c.trace("finished walking files")
+
+}
+
+// walkDir walks the directory dir, whose slash separated path relative to the prefix is rel,
+// in lexical order.
+// The ancestors are the directories being walked, including dir,
+// so that following a link to one of them is detected as a loop.
+func (c *Config) walkDir(dir string, rel string, ancestors []os.FileInfo) {
+	f, err := os.Open(dir)
+	if err != nil {
+		c.fail(OpWalk, dir, err)
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		// Its content is skipped.
+		c.fail(OpWalk, dir, err)
+		return
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		r := path.Join(rel, name)
+		info, link, err := c.statFile(p)
+		if err == errSkipped {
+			count(&c.report.Excluded, 1)
+			c.log.Debug("symbolic link skipped", "key", r)
+			continue
+		}
+		if err != nil {
+			c.fail(OpWalk, p, err)
+			continue
+		}
+		if info.IsDir() {
+			if c.filter.ignored(r, true) {
+				count(&c.report.Excluded, 1)
+				c.log.Debug("excluded", "key", r)
+				continue
+			}
+			if loop(ancestors, info) {
+				c.fail(OpWalk, p, errors.New("symbolic link loop"))
+				continue
+			}
+			c.walkDir(p, r, append(ancestors[:len(ancestors):len(ancestors)], info))
+			continue
+		}
+		if link == "" && !info.Mode().IsRegular() {
+			// devices, pipes, sockets ...
+			c.log.Debug("not a regular file, ignored", "key", r)
+			continue
+		}
+		if strings.HasPrefix(name, tmpPrefix) {
+			// unfinished download
+			continue
+		}
+		if c.filter.skipFile(r) {
+			count(&c.report.Excluded, 1)
+			c.log.Debug("excluded", "key", r)
+			continue
+		}
+		i := newSrcFile(p, info, link)
+		if link == "" {
+			if id, ok := fileID(info); ok {
+				if primary, found := c.inodes[id]; found {
+					i.hardlink, i.size = primary, 0
+				} else {
+					c.inodes[id] = r
+				}
+			}
+		}
+
+		if len(i.absPath) >= c.maxKeyLength {
+			c.fail(OpWalk, i.absPath, errors.New("file name exceeds allowed length"))
+			continue
+		}
+		if !c.mode.isSnapshot() && c.isReservedKey(c.getKey(i)) {
+			c.fail(OpWalk, i.absPath, errors.New("file name reserved by the store"))
+			continue
+		}
+		// trigger file processing
+		count(&c.report.FilesScanned, 1)
+		c.files <- i
+	}
+}
+
+// loop checks if dir is one of the ancestors.
+func loop(ancestors []os.FileInfo, dir os.FileInfo) bool {
+	for _, a := range ancestors {
+		if os.SameFile(a, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// newSrcFile describes a walked file, see statFile.
+// Stored links are empty.
+func newSrcFile(absPath string, info os.FileInfo, link string) SrcFile {
+	sf := SrcFile{absPath: absPath, updated: info.ModTime().UTC(), ctime: changeTime(info), size: info.Size(), link: link}
+	if link != "" {
+		sf.size = 0
+	}
+	return sf
+}